@@ -10,6 +10,10 @@ import (
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/tracing"
 )
 
 func main() {
@@ -38,8 +42,16 @@ func main() {
 
 	log.Printf("[Subscriber %s] Connected to NATS at %s", *subscriberID, *natsURL)
 
+	tracer := otel.Tracer("github.com/assylzhan-a/outboxie/cmd/subscriber")
+
 	sub, err := nc.Subscribe("orders.created", func(msg *nats.Msg) {
-		log.Printf("[Subscriber %s] Received order created event: %s", *subscriberID, string(msg.Data))
+		// Continue the trace the order was created in
+		msgCtx := tracing.ExtractNats(ctx, msg.Header)
+		_, span := tracer.Start(msgCtx, "orders.created process", trace.WithSpanKind(trace.SpanKindConsumer))
+		defer span.End()
+
+		log.Printf("[Subscriber %s] Received order created event (outbox message %s, trace %s): %s",
+			*subscriberID, msg.Header.Get("Outbox-Message-Id"), span.SpanContext().TraceID(), string(msg.Data))
 	})
 	if err != nil {
 		log.Fatalf("[Subscriber %s] Failed to subscribe to orders.created: %v", *subscriberID, err)
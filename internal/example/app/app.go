@@ -9,12 +9,15 @@ import (
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/assylzhan-a/outboxie/internal/example/handler"
 	"github.com/assylzhan-a/outboxie/internal/example/repository"
 	"github.com/assylzhan-a/outboxie/internal/example/service"
 	"github.com/assylzhan-a/outboxie/pkg/outbox"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/metrics"
 )
 
 type Config struct {
@@ -62,11 +65,23 @@ func (a *App) Setup(ctx context.Context) error {
 	}
 	log.Println("Connected to PostgreSQL")
 
+	outboxMetrics, err := metrics.NewPrometheusMetrics(prometheus.DefaultRegisterer)
+	if err != nil {
+		return fmt.Errorf("failed to create outbox metrics: %w", err)
+	}
+
 	// Create the outbox configuration
 	outboxConfig := config.NewOutboxConfig(dbPool, a.config.NatsURL, a.config.InstanceID).
-		WithPollingInterval(100 * time.Millisecond).
+		WithPollingInterval(100*time.Millisecond).
 		WithBatchSize(10).
-		WithMaxRetries(3)
+		WithMaxRetries(3).
+		WithRetention(24*time.Hour, 7*24*time.Hour).
+		WithMetrics(outboxMetrics).
+		WithSchemaVerification()
+
+	if err := outbox.Migrate(ctx, outboxConfig); err != nil {
+		return fmt.Errorf("failed to migrate outbox schema: %w", err)
+	}
 
 	// Create the outbox
 	outboxService, err := outbox.New(outboxConfig)
@@ -92,6 +107,7 @@ func (a *App) Setup(ctx context.Context) error {
 	orderHandler := handler.NewOrderHandler(orderService)
 
 	mux.HandleFunc("/orders", orderHandler.CreateOrder)
+	mux.Handle("/metrics", promhttp.Handler())
 
 	a.server = &http.Server{
 		Addr:    fmt.Sprintf(":%d", a.config.HTTPPort),
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 
+	"go.opentelemetry.io/otel/propagation"
+
 	"github.com/assylzhan-a/outboxie/internal/example/model"
 	"github.com/assylzhan-a/outboxie/internal/example/service"
 )
@@ -31,7 +33,8 @@ func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := r.Context()
+	// Continue the caller's trace, if any, so it is carried through the outbox to subscribers
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
 	createdOrder, err := h.orderService.CreateOrder(ctx, &order)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create order: %v", err), http.StatusInternalServerError)
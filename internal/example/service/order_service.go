@@ -60,8 +60,9 @@ func (s *OrderService) CreateOrder(ctx context.Context, orderData *model.Order)
 		CreatedAt:  orderData.CreatedAt,
 	}
 
-	// Enqueue the event to be published after the transaction is committed
-	if err := s.outboxService.EnqueueMessage(ctx, tx, "orders.created", event); err != nil {
+	// Enqueue the event to be published after the transaction is committed, at most once per order
+	idempotencyKey := "orders.created:" + orderData.ID.String()
+	if err := s.outboxService.EnqueueMessage(ctx, tx, "orders.created", event, outbox.WithIdempotencyKey(idempotencyKey)); err != nil {
 		return nil, fmt.Errorf("failed to enqueue message: %w", err)
 	}
 
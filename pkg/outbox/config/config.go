@@ -1,29 +1,141 @@
 package config
 
 import (
+	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/metrics"
+)
+
+// DefaultNotifyChannel is the PostgreSQL channel used when LISTEN/NOTIFY is enabled.
+// Outboxes with custom table names use a channel named after their messages table instead.
+const DefaultNotifyChannel = "outbox_messages"
+
+// ProcessingMode determines how instances share the work of publishing messages
+type ProcessingMode string
+
+const (
+	// ModeLeaderElection lets only the elected leader publish messages. Messages with the same
+	// partition key are published in order, other messages in sequence order on a best-effort basis.
+	ModeLeaderElection ProcessingMode = "leader_election"
+	// ModeCompetingConsumers lets every instance claim and publish batches concurrently
+	// using SELECT ... FOR UPDATE SKIP LOCKED. Partition keys still keep their order.
+	ModeCompetingConsumers ProcessingMode = "competing_consumers"
+)
+
+// LeaderElectionBackend determines how the leader is elected in leader election mode
+type LeaderElectionBackend string
+
+const (
+	// LeaderElectionHeartbeat keeps a lease row in the leader election table alive with heartbeats
+	LeaderElectionHeartbeat LeaderElectionBackend = "heartbeat"
+	// LeaderElectionAdvisoryLock holds a PostgreSQL session advisory lock on a dedicated connection,
+	// which the server releases as soon as the leader's session ends
+	LeaderElectionAdvisoryLock LeaderElectionBackend = "advisory_lock"
+	// LeaderElectionNatsKV holds the leader key of a NATS JetStream key-value bucket, which expires
+	// when the leader stops renewing it, keeping leadership heartbeats off PostgreSQL
+	LeaderElectionNatsKV LeaderElectionBackend = "nats_kv"
 )
 
+// DefaultLeaderElectionBucket is the JetStream key-value bucket used by the NATS KV backend
+const DefaultLeaderElectionBucket = "outbox_leader_election"
+
+// LeaderElectionConfig configures how instances elect the leader in leader election mode.
+// All instances competing for leadership must use the same lease TTL.
+type LeaderElectionConfig struct {
+	Backend       LeaderElectionBackend // Mechanism used to elect the leader
+	LeaseTTL      time.Duration         // How long leadership lasts without renewal; failover takes up to this long
+	RenewInterval time.Duration         // How often the leader renews its lease
+	RetryInterval time.Duration         // How often followers try to become the leader
+	Bucket        string                // Key-value bucket of the NATS KV backend, created with the lease TTL if missing
+}
+
 type OutboxConfig struct {
-	DB              *pgxpool.Pool   // connection pool
-	NatsURL         string          // URL NATS
-	InstanceID      string          // Unique identifier for this instance
-	ProcessorConfig ProcessorConfig // Configuration for the message processor
+	DB              *pgxpool.Pool        // connection pool
+	NatsURL         string               // URL NATS
+	InstanceID      string               // Unique identifier for this instance
+	ProcessorConfig ProcessorConfig      // Configuration for the message processor
+	JetStream       *JetStreamConfig     // Publish through JetStream instead of core NATS when set
+	Metrics         metrics.Metrics      // Receives outbox metrics, discarded if nil
+	TracerProvider  trace.TracerProvider // Creates publish spans, the global provider is used if nil
+	VerifySchema    bool                 // Fail outbox creation if the schema is not migrated to the expected version
+	Tables          TableConfig          // Names of the outbox tables
+	Archive         bool                 // Move completed messages to the archive table instead of keeping them
+	LeaderElection  LeaderElectionConfig // How the leader is elected in leader election mode
+}
+
+// JetStreamConfig configures publishing through a NATS JetStream stream
+type JetStreamConfig struct {
+	StreamName      string        // Stream that captures the outbox topics
+	Subjects        []string      // Subjects of the stream if it is created on startup
+	CreateStream    bool          // Create the stream on startup if it doesn't exist
+	DuplicateWindow time.Duration // Window in which the stream deduplicates redelivered messages
+	AckTimeout      time.Duration // How long to wait for the stream to acknowledge a message
 }
 
 type ProcessorConfig struct {
-	PollingInterval time.Duration // How often to poll for new messages
-	BatchSize       int           // Max number of messages to process in a batch
-	MaxRetries      int           // Max retries for a failed message
+	Mode             ProcessingMode // How instances share the work of publishing messages
+	PollingInterval  time.Duration  // How often to poll for new messages
+	BatchSize        int            // Max number of messages to process in a batch
+	MaxRetries       int            // Max retries for a failed message
+	RetryBaseDelay   time.Duration  // Delay before the first retry, doubled on every subsequent attempt
+	RetryMaxDelay    time.Duration  // Upper bound for the delay between retries
+	DeadLetterTopic  string         // Optional topic dead-lettered messages are re-published to
+	LockTimeout      time.Duration  // How long a claimed message stays locked before it can be recovered
+	RecoveryInterval time.Duration  // How often to return messages with expired locks to pending
+	NotifyChannel    string         // PostgreSQL channel used to wake up the processor on enqueue, disabled if empty
+	MetricsInterval  time.Duration  // How often to collect backlog metrics when metrics are enabled
+	PriorityAging    time.Duration  // Waiting this long raises the priority of a message by one, disabled if zero, the default
+	FairShare        float64        // Share of every claim reserved for the oldest ready messages whatever their priority, disabled if zero
+	Workers          int            // Number of goroutines publishing claimed messages
+	MaxInFlight      int            // Max number of claimed messages not yet published, Workers * BatchSize if zero
+
+	CompletedRetention      time.Duration // How long completed messages are kept, forever if zero
+	DeadLetterRetention     time.Duration // How long dead letters, failed and expired messages are kept, forever if zero
+	IdempotencyKeyRetention time.Duration // How long idempotency keys are remembered once their message left the outbox, forever if zero
+	CleanupInterval         time.Duration // How often to delete messages whose retention elapsed
+	CleanupBatchSize        int           // Max number of rows deleted by a single statement
 }
 
 func DefaultProcessorConfig() ProcessorConfig {
 	return ProcessorConfig{
-		PollingInterval: 100 * time.Millisecond,
-		BatchSize:       10,
-		MaxRetries:      3,
+		Mode:             ModeLeaderElection,
+		PollingInterval:  100 * time.Millisecond,
+		BatchSize:        10,
+		MaxRetries:       3,
+		RetryBaseDelay:   time.Second,
+		RetryMaxDelay:    time.Minute,
+		LockTimeout:      30 * time.Second,
+		RecoveryInterval: 10 * time.Second,
+		MetricsInterval:  15 * time.Second,
+		FairShare:        0.1,
+		Workers:          1,
+		CleanupInterval:  time.Minute,
+		CleanupBatchSize: 1000,
+	}
+}
+
+// NewJetStreamConfig returns a JetStream configuration for a stream capturing the given subjects
+func NewJetStreamConfig(streamName string, subjects ...string) JetStreamConfig {
+	return JetStreamConfig{
+		StreamName:      streamName,
+		Subjects:        subjects,
+		DuplicateWindow: 2 * time.Minute,
+		AckTimeout:      5 * time.Second,
+	}
+}
+
+func DefaultLeaderElectionConfig() LeaderElectionConfig {
+	return LeaderElectionConfig{
+		Backend:       LeaderElectionHeartbeat,
+		LeaseTTL:      10 * time.Second,
+		RenewInterval: 3 * time.Second,
+		RetryInterval: 2 * time.Second,
+		Bucket:        DefaultLeaderElectionBucket,
 	}
 }
 
@@ -33,7 +145,85 @@ func NewOutboxConfig(db *pgxpool.Pool, natsURL string, instanceID string) Outbox
 		NatsURL:         natsURL,
 		InstanceID:      instanceID,
 		ProcessorConfig: DefaultProcessorConfig(),
+		Tables:          DefaultTableConfig(),
+		LeaderElection:  DefaultLeaderElectionConfig(),
+	}
+}
+
+// Validate checks the configuration for values that would fail at runtime
+func (c OutboxConfig) Validate() error {
+	if err := c.Tables.Validate(); err != nil {
+		return fmt.Errorf("invalid table configuration: %w", err)
+	}
+
+	if err := c.LeaderElection.Validate(); err != nil {
+		return fmt.Errorf("invalid leader election configuration: %w", err)
+	}
+	if c.LeaderElection.Backend == LeaderElectionNatsKV && !keyPattern.MatchString(c.Tables.LeaderKey) {
+		return fmt.Errorf("leader key %q is not a valid key-value bucket key", c.Tables.LeaderKey)
+	}
+
+	pc := c.ProcessorConfig
+	if pc.PollingInterval <= 0 || pc.RecoveryInterval <= 0 {
+		return fmt.Errorf("polling interval and recovery interval must be positive")
 	}
+	if pc.LockTimeout <= 0 {
+		return fmt.Errorf("lock timeout must be positive")
+	}
+	if c.Metrics != nil && pc.MetricsInterval <= 0 {
+		return fmt.Errorf("metrics interval must be positive when metrics are enabled")
+	}
+	if pc.FairShare < 0 || pc.FairShare > 1 {
+		return fmt.Errorf("fair share must be between 0 and 1")
+	}
+	if pc.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+	if pc.MaxInFlight < 0 {
+		return fmt.Errorf("max in-flight messages must not be negative")
+	}
+
+	if pc.CompletedRetention > 0 || pc.DeadLetterRetention > 0 || pc.IdempotencyKeyRetention > 0 {
+		if pc.CleanupInterval <= 0 {
+			return fmt.Errorf("cleanup interval must be positive when a retention is set")
+		}
+		if pc.CleanupBatchSize <= 0 {
+			return fmt.Errorf("cleanup batch size must be positive when a retention is set")
+		}
+	}
+
+	return nil
+}
+
+var (
+	// bucketPattern matches the names JetStream accepts for key-value buckets
+	bucketPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	// keyPattern matches the keys JetStream accepts in key-value buckets
+	keyPattern = regexp.MustCompile(`^[-/_=a-zA-Z0-9]+(\.[-/_=a-zA-Z0-9]+)*$`)
+)
+
+// Validate checks that the lease can be renewed several times before it expires
+func (c LeaderElectionConfig) Validate() error {
+	switch c.Backend {
+	case LeaderElectionHeartbeat, LeaderElectionAdvisoryLock, "":
+	case LeaderElectionNatsKV:
+		if !bucketPattern.MatchString(c.Bucket) {
+			return fmt.Errorf("invalid leader election bucket: %q", c.Bucket)
+		}
+	default:
+		return fmt.Errorf("unknown leader election backend: %q", c.Backend)
+	}
+
+	if c.LeaseTTL <= 0 || c.RenewInterval <= 0 || c.RetryInterval <= 0 {
+		return fmt.Errorf("lease TTL, renew interval and retry interval must be positive")
+	}
+
+	// A leader that renews at most every half lease survives a single failed renewal
+	if c.RenewInterval > c.LeaseTTL/2 {
+		return fmt.Errorf("renew interval %s must be at most half of the lease TTL %s", c.RenewInterval, c.LeaseTTL)
+	}
+
+	return nil
 }
 
 func (c OutboxConfig) WithPollingInterval(interval time.Duration) OutboxConfig {
@@ -50,3 +240,144 @@ func (c OutboxConfig) WithMaxRetries(maxRetries int) OutboxConfig {
 	c.ProcessorConfig.MaxRetries = maxRetries
 	return c
 }
+
+func (c OutboxConfig) WithRetryBackoff(baseDelay, maxDelay time.Duration) OutboxConfig {
+	c.ProcessorConfig.RetryBaseDelay = baseDelay
+	c.ProcessorConfig.RetryMaxDelay = maxDelay
+	return c
+}
+
+func (c OutboxConfig) WithDeadLetterTopic(topic string) OutboxConfig {
+	c.ProcessorConfig.DeadLetterTopic = topic
+	return c
+}
+
+func (c OutboxConfig) WithLockTimeout(timeout time.Duration) OutboxConfig {
+	c.ProcessorConfig.LockTimeout = timeout
+	return c
+}
+
+func (c OutboxConfig) WithRecoveryInterval(interval time.Duration) OutboxConfig {
+	c.ProcessorConfig.RecoveryInterval = interval
+	return c
+}
+
+func (c OutboxConfig) WithProcessingMode(mode ProcessingMode) OutboxConfig {
+	c.ProcessorConfig.Mode = mode
+	return c
+}
+
+// WithPriorityAging raises the priority of a waiting message by one for every interval it waits,
+// so that lower priority messages still make progress while higher priority ones keep arriving.
+// Aging is disabled by default because aged priorities depend on the current time and cannot be
+// read from an index: every claim then sorts all ready messages, which gets slow on large backlogs.
+func (c OutboxConfig) WithPriorityAging(interval time.Duration) OutboxConfig {
+	c.ProcessorConfig.PriorityAging = interval
+	return c
+}
+
+// WithFairShare reserves the given share of every claim for the oldest ready messages, whatever
+// their priority, so a steady stream of high priority messages cannot starve lower priority ones.
+// Unlike priority aging, the reserved share is still claimed in index order.
+func (c OutboxConfig) WithFairShare(share float64) OutboxConfig {
+	c.ProcessorConfig.FairShare = share
+	return c
+}
+
+// WithWorkers publishes claimed messages on the given number of goroutines. Messages with the
+// same partition key are always published by the same worker, while messages without a key are
+// spread across all workers.
+func (c OutboxConfig) WithWorkers(workers int) OutboxConfig {
+	c.ProcessorConfig.Workers = workers
+	return c
+}
+
+// WithMaxInFlight bounds how many claimed messages may wait to be published at once; no more
+// messages are claimed until workers catch up
+func (c OutboxConfig) WithMaxInFlight(maxInFlight int) OutboxConfig {
+	c.ProcessorConfig.MaxInFlight = maxInFlight
+	return c
+}
+
+// WithLeaderElectionBackend selects how the leader is elected in leader election mode
+func (c OutboxConfig) WithLeaderElectionBackend(backend LeaderElectionBackend) OutboxConfig {
+	c.LeaderElection.Backend = backend
+	return c
+}
+
+// WithLeaderElectionBucket sets the key-value bucket the NATS KV backend keeps the leader key in
+func (c OutboxConfig) WithLeaderElectionBucket(bucket string) OutboxConfig {
+	c.LeaderElection.Bucket = bucket
+	return c
+}
+
+// WithLeaderLease sets how long leadership lasts without renewal, how often the leader renews it
+// and how often followers try to take over. The renew interval must be at most half of the TTL.
+func (c OutboxConfig) WithLeaderLease(leaseTTL, renewInterval, retryInterval time.Duration) OutboxConfig {
+	c.LeaderElection.LeaseTTL = leaseTTL
+	c.LeaderElection.RenewInterval = renewInterval
+	c.LeaderElection.RetryInterval = retryInterval
+	return c
+}
+
+func (c OutboxConfig) WithJetStream(jetStream JetStreamConfig) OutboxConfig {
+	c.JetStream = &jetStream
+	return c
+}
+
+// WithListenNotify wakes the processor up through PostgreSQL LISTEN/NOTIFY as soon as a message
+// is committed, and lowers polling to the given fallback interval
+func (c OutboxConfig) WithListenNotify(fallbackPollingInterval time.Duration) OutboxConfig {
+	c.ProcessorConfig.NotifyChannel = DefaultNotifyChannel
+	c.ProcessorConfig.PollingInterval = fallbackPollingInterval
+	return c
+}
+
+// WithRetention deletes completed messages, and dead letters together with failed and expired messages,
+// once they are older than the given retention. A zero retention keeps the rows forever.
+func (c OutboxConfig) WithRetention(completed, deadLetters time.Duration) OutboxConfig {
+	c.ProcessorConfig.CompletedRetention = completed
+	c.ProcessorConfig.DeadLetterRetention = deadLetters
+	return c
+}
+
+// WithIdempotencyKeyRetention forgets idempotency keys once they are older than the given
+// retention and their message was published or dead-lettered, so a message with the same key can
+// be enqueued again. A zero retention remembers the keys forever.
+func (c OutboxConfig) WithIdempotencyKeyRetention(retention time.Duration) OutboxConfig {
+	c.ProcessorConfig.IdempotencyKeyRetention = retention
+	return c
+}
+
+func (c OutboxConfig) WithCleanup(interval time.Duration, batchSize int) OutboxConfig {
+	c.ProcessorConfig.CleanupInterval = interval
+	c.ProcessorConfig.CleanupBatchSize = batchSize
+	return c
+}
+
+// WithArchive moves every completed message to the archive table, where it is kept for lookups,
+// so that the messages table only holds messages that still need to be published
+func (c OutboxConfig) WithArchive() OutboxConfig {
+	c.Archive = true
+	return c
+}
+
+func (c OutboxConfig) WithMetrics(m metrics.Metrics) OutboxConfig {
+	c.Metrics = m
+	return c
+}
+
+func (c OutboxConfig) WithTracerProvider(tp trace.TracerProvider) OutboxConfig {
+	c.TracerProvider = tp
+	return c
+}
+
+func (c OutboxConfig) WithSchemaVerification() OutboxConfig {
+	c.VerifySchema = true
+	return c
+}
+
+func (c OutboxConfig) WithTables(tables TableConfig) OutboxConfig {
+	c.Tables = tables
+	return c
+}
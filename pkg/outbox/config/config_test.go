@@ -1,19 +1,37 @@
 package config
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/metrics"
 )
 
 func TestDefaultProcessorConfig(t *testing.T) {
 	config := DefaultProcessorConfig()
 
+	assert.Equal(t, ModeLeaderElection, config.Mode)
 	assert.Equal(t, 100*time.Millisecond, config.PollingInterval)
 	assert.Equal(t, 10, config.BatchSize)
 	assert.Equal(t, 3, config.MaxRetries)
+	assert.Equal(t, time.Second, config.RetryBaseDelay)
+	assert.Equal(t, time.Minute, config.RetryMaxDelay)
+	assert.Equal(t, 30*time.Second, config.LockTimeout)
+	assert.Equal(t, 10*time.Second, config.RecoveryInterval)
+	assert.Equal(t, 15*time.Second, config.MetricsInterval)
+	assert.Zero(t, config.PriorityAging)
+	assert.Equal(t, 0.1, config.FairShare)
+	assert.Equal(t, 1, config.Workers)
+	assert.Zero(t, config.MaxInFlight)
+	assert.Zero(t, config.CompletedRetention)
+	assert.Zero(t, config.DeadLetterRetention)
+	assert.Zero(t, config.IdempotencyKeyRetention)
+	assert.Equal(t, time.Minute, config.CleanupInterval)
+	assert.Equal(t, 1000, config.CleanupBatchSize)
 }
 
 func TestNewOutboxConfig(t *testing.T) {
@@ -30,6 +48,14 @@ func TestNewOutboxConfig(t *testing.T) {
 	assert.Equal(t, 100*time.Millisecond, config.ProcessorConfig.PollingInterval)
 	assert.Equal(t, 10, config.ProcessorConfig.BatchSize)
 	assert.Equal(t, 3, config.ProcessorConfig.MaxRetries)
+
+	assert.Equal(t, DefaultTableConfig(), config.Tables)
+	assert.Equal(t, DefaultLeaderElectionConfig(), config.LeaderElection)
+	assert.Equal(t, 10*time.Second, config.LeaderElection.LeaseTTL)
+	assert.Equal(t, 3*time.Second, config.LeaderElection.RenewInterval)
+	assert.Equal(t, 2*time.Second, config.LeaderElection.RetryInterval)
+	assert.Equal(t, DefaultLeaderElectionBucket, config.LeaderElection.Bucket)
+	assert.NoError(t, config.Validate())
 }
 
 func TestConfigBuilderMethods(t *testing.T) {
@@ -60,4 +86,146 @@ func TestConfigBuilderMethods(t *testing.T) {
 	assert.Equal(t, newInterval, chainedConfig.ProcessorConfig.PollingInterval)
 	assert.Equal(t, newBatchSize, chainedConfig.ProcessorConfig.BatchSize)
 	assert.Equal(t, newMaxRetries, chainedConfig.ProcessorConfig.MaxRetries)
+
+	configWithBackoff := config.WithRetryBackoff(2*time.Second, 30*time.Second)
+	assert.Equal(t, 2*time.Second, configWithBackoff.ProcessorConfig.RetryBaseDelay)
+	assert.Equal(t, 30*time.Second, configWithBackoff.ProcessorConfig.RetryMaxDelay)
+
+	configWithDeadLetterTopic := config.WithDeadLetterTopic("outbox.dlq")
+	assert.Equal(t, "outbox.dlq", configWithDeadLetterTopic.ProcessorConfig.DeadLetterTopic)
+
+	configWithLockTimeout := config.WithLockTimeout(time.Minute)
+	assert.Equal(t, time.Minute, configWithLockTimeout.ProcessorConfig.LockTimeout)
+
+	configWithRecoveryInterval := config.WithRecoveryInterval(5 * time.Second)
+	assert.Equal(t, 5*time.Second, configWithRecoveryInterval.ProcessorConfig.RecoveryInterval)
+
+	configWithMode := config.WithProcessingMode(ModeCompetingConsumers)
+	assert.Equal(t, ModeCompetingConsumers, configWithMode.ProcessorConfig.Mode)
+
+	configWithPriorityAging := config.WithPriorityAging(30 * time.Second)
+	assert.Equal(t, 30*time.Second, configWithPriorityAging.ProcessorConfig.PriorityAging)
+
+	configWithFairShare := config.WithFairShare(0.25)
+	assert.Equal(t, 0.25, configWithFairShare.ProcessorConfig.FairShare)
+	assert.NoError(t, configWithFairShare.Validate())
+	assert.NoError(t, config.WithFairShare(0).Validate())
+	assert.Error(t, config.WithFairShare(1.5).Validate())
+
+	configWithWorkers := config.WithWorkers(4).WithMaxInFlight(100)
+	assert.Equal(t, 4, configWithWorkers.ProcessorConfig.Workers)
+	assert.Equal(t, 100, configWithWorkers.ProcessorConfig.MaxInFlight)
+	assert.NoError(t, configWithWorkers.Validate())
+	assert.Error(t, config.WithWorkers(0).Validate())
+	assert.Error(t, config.WithMaxInFlight(-1).Validate())
+
+	assert.Error(t, config.WithPollingInterval(0).Validate())
+	assert.Error(t, config.WithRecoveryInterval(0).Validate())
+	assert.Error(t, config.WithLockTimeout(-time.Second).Validate())
+	configWithoutMetricsInterval := config
+	configWithoutMetricsInterval.ProcessorConfig.MetricsInterval = 0
+	assert.NoError(t, configWithoutMetricsInterval.Validate(), "metrics are not collected")
+	assert.Error(t, configWithoutMetricsInterval.WithMetrics(metrics.NoopMetrics{}).Validate())
+
+	configWithAdvisoryLock := config.WithLeaderElectionBackend(LeaderElectionAdvisoryLock)
+	assert.Equal(t, LeaderElectionAdvisoryLock, configWithAdvisoryLock.LeaderElection.Backend)
+	assert.NoError(t, configWithAdvisoryLock.Validate())
+	assert.Error(t, config.WithLeaderElectionBackend("zookeeper").Validate())
+
+	configWithNatsKV := config.WithLeaderElectionBackend(LeaderElectionNatsKV).WithLeaderElectionBucket("leaders")
+	assert.Equal(t, LeaderElectionNatsKV, configWithNatsKV.LeaderElection.Backend)
+	assert.Equal(t, "leaders", configWithNatsKV.LeaderElection.Bucket)
+	assert.NoError(t, configWithNatsKV.Validate())
+	assert.Error(t, configWithNatsKV.WithLeaderElectionBucket("outbox.leaders").Validate())
+	assert.Error(t, configWithNatsKV.WithLeaderElectionBucket("").Validate())
+
+	tables := DefaultTableConfig()
+	tables.LeaderKey = "orders outbox"
+	assert.Error(t, configWithNatsKV.WithTables(tables).Validate(), "leader key must be a valid key")
+	assert.NoError(t, config.WithTables(tables).Validate(), "other backends accept any leader key")
+
+	configWithLease := config.WithLeaderLease(4*time.Second, time.Second, 500*time.Millisecond)
+	assert.Equal(t, 4*time.Second, configWithLease.LeaderElection.LeaseTTL)
+	assert.Equal(t, time.Second, configWithLease.LeaderElection.RenewInterval)
+	assert.Equal(t, 500*time.Millisecond, configWithLease.LeaderElection.RetryInterval)
+	assert.NoError(t, configWithLease.Validate())
+	assert.Error(t, config.WithLeaderLease(4*time.Second, 3*time.Second, time.Second).Validate(), "renewing too close to expiry")
+	assert.Error(t, config.WithLeaderLease(0, time.Second, time.Second).Validate())
+	assert.Error(t, config.WithLeaderLease(4*time.Second, time.Second, 0).Validate())
+
+	configWithListenNotify := config.WithListenNotify(5 * time.Second)
+	assert.Equal(t, DefaultNotifyChannel, configWithListenNotify.ProcessorConfig.NotifyChannel)
+	assert.Equal(t, 5*time.Second, configWithListenNotify.ProcessorConfig.PollingInterval)
+	assert.Empty(t, config.ProcessorConfig.NotifyChannel)
+
+	configWithRetention := config.WithRetention(24*time.Hour, 30*24*time.Hour)
+	assert.Equal(t, 24*time.Hour, configWithRetention.ProcessorConfig.CompletedRetention)
+	assert.Equal(t, 30*24*time.Hour, configWithRetention.ProcessorConfig.DeadLetterRetention)
+
+	configWithCleanup := config.WithCleanup(5*time.Minute, 500)
+	assert.Equal(t, 5*time.Minute, configWithCleanup.ProcessorConfig.CleanupInterval)
+	assert.Equal(t, 500, configWithCleanup.ProcessorConfig.CleanupBatchSize)
+
+	assert.NoError(t, configWithRetention.Validate())
+	assert.Error(t, configWithRetention.WithCleanup(time.Minute, 0).Validate())
+	assert.Error(t, configWithRetention.WithCleanup(0, 100).Validate())
+
+	configWithKeyRetention := config.WithIdempotencyKeyRetention(7 * 24 * time.Hour)
+	assert.Equal(t, 7*24*time.Hour, configWithKeyRetention.ProcessorConfig.IdempotencyKeyRetention)
+	assert.NoError(t, configWithKeyRetention.Validate())
+	assert.Error(t, configWithKeyRetention.WithCleanup(0, 100).Validate())
+
+	assert.Nil(t, config.Metrics)
+	configWithMetrics := config.WithMetrics(metrics.NoopMetrics{})
+	assert.Equal(t, metrics.NoopMetrics{}, configWithMetrics.Metrics)
+
+	assert.False(t, config.Archive)
+	assert.True(t, config.WithArchive().Archive)
+
+	assert.False(t, config.VerifySchema)
+	assert.True(t, config.WithSchemaVerification().VerifySchema)
+
+	assert.Nil(t, config.JetStream)
+	jetStream := NewJetStreamConfig("ORDERS", "orders.>")
+	configWithJetStream := config.WithJetStream(jetStream)
+	if assert.NotNil(t, configWithJetStream.JetStream) {
+		assert.Equal(t, "ORDERS", configWithJetStream.JetStream.StreamName)
+		assert.Equal(t, []string{"orders.>"}, configWithJetStream.JetStream.Subjects)
+		assert.Equal(t, 2*time.Minute, configWithJetStream.JetStream.DuplicateWindow)
+		assert.Equal(t, 5*time.Second, configWithJetStream.JetStream.AckTimeout)
+	}
+}
+
+func TestTableConfig(t *testing.T) {
+	tables := DefaultTableConfig()
+	assert.NoError(t, tables.Validate())
+	assert.Equal(t, `"outbox_messages"`, tables.Table(tables.Messages))
+	assert.Equal(t, DefaultNotifyChannel, tables.NotifyChannel())
+
+	tables.Schema = "billing"
+	tables.Messages = "billing_outbox"
+	assert.NoError(t, tables.Validate())
+	assert.Equal(t, `"billing"."billing_outbox"`, tables.Table(tables.Messages))
+	assert.Equal(t, "billing.billing_outbox", tables.NotifyChannel())
+
+	invalid := []func(*TableConfig){
+		func(c *TableConfig) { c.Schema = "billing; DROP TABLE orders" },
+		func(c *TableConfig) { c.Messages = "" },
+		func(c *TableConfig) { c.DeadLetters = "dead-letters" },
+		func(c *TableConfig) { c.Archive = "archive.messages" },
+		func(c *TableConfig) { c.LeaderElection = "1leader" },
+		func(c *TableConfig) { c.Migrations = strings.Repeat("m", 64) },
+		func(c *TableConfig) { c.Messages = strings.Repeat("m", 41) },
+		func(c *TableConfig) { c.IdempotencyKeys = strings.Repeat("k", 41) },
+		func(c *TableConfig) { c.Schema = strings.Repeat("s", 30); c.Messages = strings.Repeat("m", 33) },
+		func(c *TableConfig) { c.LeaderKey = "" },
+	}
+	for _, modify := range invalid {
+		tables := DefaultTableConfig()
+		modify(&tables)
+		assert.Error(t, tables.Validate())
+
+		config := NewOutboxConfig(nil, "nats://localhost:4222", "test-instance").WithTables(tables)
+		assert.Error(t, config.Validate())
+	}
 }
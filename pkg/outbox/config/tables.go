@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// identifierPattern matches the unquoted PostgreSQL identifiers accepted for table and schema names
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// maxIdentifierLength is the PostgreSQL limit; longer names would be silently truncated
+const maxIdentifierLength = 63
+
+// indexNameOverhead is what the migrations add to a table name to name its indexes, for the longest suffix
+const indexNameOverhead = len("idx_") + len("_expired_created_at")
+
+// TableConfig names the database objects used by the outbox, so that several services
+// can keep separate outboxes in the same database
+type TableConfig struct {
+	Schema          string // Schema of the outbox tables, the search_path is used if empty
+	Messages        string // Table of messages waiting to be published
+	DeadLetters     string // Table of messages that exhausted their retries
+	Archive         string // Table completed messages are moved to in archive mode
+	IdempotencyKeys string // Table remembering the idempotency keys of enqueued messages
+	LeaderElection  string // Table holding the leader lease
+	Migrations      string // Table recording the applied schema migrations
+	LeaderKey       string // Row of the leader election table this outbox competes for
+}
+
+func DefaultTableConfig() TableConfig {
+	return TableConfig{
+		Messages:        "outbox_messages",
+		DeadLetters:     "outbox_dead_letters",
+		Archive:         "outbox_messages_archive",
+		IdempotencyKeys: "outbox_idempotency_keys",
+		LeaderElection:  "leader_election",
+		Migrations:      "outbox_schema_migrations",
+		LeaderKey:       "outbox_leader",
+	}
+}
+
+// Validate checks that all names are plain identifiers, short enough for the names derived from them
+func (t TableConfig) Validate() error {
+	if t.Schema != "" {
+		if err := validateIdentifier("schema", t.Schema); err != nil {
+			return err
+		}
+	}
+
+	names := []struct{ kind, name string }{
+		{"messages table", t.Messages},
+		{"dead letters table", t.DeadLetters},
+		{"archive table", t.Archive},
+		{"idempotency keys table", t.IdempotencyKeys},
+		{"leader election table", t.LeaderElection},
+		{"migrations table", t.Migrations},
+	}
+	for _, n := range names {
+		if err := validateIdentifier(n.kind, n.name); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range names[:4] {
+		if len(n.name)+indexNameOverhead > maxIdentifierLength {
+			return fmt.Errorf("invalid %s name %q: longer than %d characters, the names of its indexes would be truncated", n.kind, n.name, maxIdentifierLength-indexNameOverhead)
+		}
+	}
+
+	if len(t.NotifyChannel()) > maxIdentifierLength {
+		return fmt.Errorf("notify channel %q is longer than %d characters, shorten the schema or messages table name", t.NotifyChannel(), maxIdentifierLength)
+	}
+
+	if t.LeaderKey == "" {
+		return fmt.Errorf("leader key must not be empty")
+	}
+
+	return nil
+}
+
+// Table returns the quoted, schema-qualified name of the given table for use in SQL
+func (t TableConfig) Table(name string) string {
+	if t.Schema == "" {
+		return pgx.Identifier{name}.Sanitize()
+	}
+	return pgx.Identifier{t.Schema, name}.Sanitize()
+}
+
+// NotifyChannel returns the LISTEN/NOTIFY channel of this outbox, named after its messages table
+func (t TableConfig) NotifyChannel() string {
+	if t.Schema == "" {
+		return t.Messages
+	}
+	return t.Schema + "." + t.Messages
+}
+
+func validateIdentifier(kind, name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("invalid %s name %q: must start with a letter or underscore and contain only letters, digits and underscores", kind, name)
+	}
+	if len(name) > maxIdentifierLength {
+		return fmt.Errorf("invalid %s name %q: longer than %d characters", kind, name, maxIdentifierLength)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import "time"
+
+// Metrics records what happens in the outbox pipeline.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// MessageEnqueued counts a message stored in the outbox. The enclosing
+	// transaction may still be rolled back after it is counted.
+	MessageEnqueued(topic string)
+	// MessagePublished counts a published message and records the time since it was enqueued
+	MessagePublished(topic string, latency time.Duration)
+	// MessageFailed counts a failed publish attempt
+	MessageFailed(topic string)
+	// MessageDeadLettered counts a message moved to the dead letter table
+	MessageDeadLettered(topic string)
+	// MessageExpired counts a message discarded because it expired before it could be published
+	MessageExpired(topic string)
+	// BatchProcessed records how long it took to process a batch
+	BatchProcessed(duration time.Duration)
+	// SetBacklog records the number of pending messages and the age of the oldest one
+	SetBacklog(pending int64, oldestAge time.Duration)
+	// SetLeader records whether this instance is currently the leader
+	SetLeader(isLeader bool)
+	// MessagesPurged counts rows of the given kind (completed, failed, expired or dead_letter)
+	// deleted by the cleanup once their retention elapsed
+	MessagesPurged(kind string, count int64)
+}
+
+// NoopMetrics discards all metrics
+type NoopMetrics struct{}
+
+func (NoopMetrics) MessageEnqueued(string)                 {}
+func (NoopMetrics) MessagePublished(string, time.Duration) {}
+func (NoopMetrics) MessageFailed(string)                   {}
+func (NoopMetrics) MessageDeadLettered(string)             {}
+func (NoopMetrics) MessageExpired(string)                  {}
+func (NoopMetrics) BatchProcessed(time.Duration)           {}
+func (NoopMetrics) SetBacklog(int64, time.Duration)        {}
+func (NoopMetrics) SetLeader(bool)                         {}
+func (NoopMetrics) MessagesPurged(string, int64)           {}
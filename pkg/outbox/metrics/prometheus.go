@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "outbox"
+
+// PrometheusMetrics exposes outbox metrics as Prometheus collectors
+type PrometheusMetrics struct {
+	enqueued       *prometheus.CounterVec
+	published      *prometheus.CounterVec
+	failed         *prometheus.CounterVec
+	deadLettered   *prometheus.CounterVec
+	expired        *prometheus.CounterVec
+	publishLatency *prometheus.HistogramVec
+	batchDuration  prometheus.Histogram
+	pending        prometheus.Gauge
+	oldestPending  prometheus.Gauge
+	leader         prometheus.Gauge
+	purged         *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics creates the outbox collectors and registers them with the given registerer
+func NewPrometheusMetrics(registerer prometheus.Registerer) (*PrometheusMetrics, error) {
+	m := &PrometheusMetrics{
+		enqueued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_enqueued_total",
+			Help:      "Number of messages stored in the outbox.",
+		}, []string{"topic"}),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_published_total",
+			Help:      "Number of messages published to the broker.",
+		}, []string{"topic"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_failed_total",
+			Help:      "Number of failed publish attempts.",
+		}, []string{"topic"}),
+		deadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_dead_lettered_total",
+			Help:      "Number of messages moved to the dead letter table after exhausting their retries.",
+		}, []string{"topic"}),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_expired_total",
+			Help:      "Number of messages discarded because they expired before they could be published.",
+		}, []string{"topic"}),
+		publishLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "publish_latency_seconds",
+			Help:      "Time between enqueuing a message and publishing it.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 15),
+		}, []string{"topic"}),
+		batchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "batch_duration_seconds",
+			Help:      "Time taken to process a batch of messages.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		pending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pending_messages",
+			Help:      "Number of messages waiting to be published.",
+		}),
+		oldestPending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "oldest_pending_message_age_seconds",
+			Help:      "Age of the oldest message waiting to be published.",
+		}),
+		leader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "is_leader",
+			Help:      "Whether this instance is the outbox leader (1) or not (0).",
+		}),
+		purged: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_purged_total",
+			Help:      "Number of rows deleted by the cleanup after their retention elapsed.",
+		}, []string{"kind"}),
+	}
+
+	collectors := []prometheus.Collector{
+		m.enqueued,
+		m.published,
+		m.failed,
+		m.deadLettered,
+		m.expired,
+		m.publishLatency,
+		m.batchDuration,
+		m.pending,
+		m.oldestPending,
+		m.leader,
+		m.purged,
+	}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return nil, fmt.Errorf("failed to register outbox metrics: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+func (m *PrometheusMetrics) MessageEnqueued(topic string) {
+	m.enqueued.WithLabelValues(topic).Inc()
+}
+
+func (m *PrometheusMetrics) MessagePublished(topic string, latency time.Duration) {
+	m.published.WithLabelValues(topic).Inc()
+	m.publishLatency.WithLabelValues(topic).Observe(latency.Seconds())
+}
+
+func (m *PrometheusMetrics) MessageFailed(topic string) {
+	m.failed.WithLabelValues(topic).Inc()
+}
+
+func (m *PrometheusMetrics) MessageDeadLettered(topic string) {
+	m.deadLettered.WithLabelValues(topic).Inc()
+}
+
+func (m *PrometheusMetrics) MessageExpired(topic string) {
+	m.expired.WithLabelValues(topic).Inc()
+}
+
+func (m *PrometheusMetrics) BatchProcessed(duration time.Duration) {
+	m.batchDuration.Observe(duration.Seconds())
+}
+
+func (m *PrometheusMetrics) SetBacklog(pending int64, oldestAge time.Duration) {
+	m.pending.Set(float64(pending))
+	m.oldestPending.Set(oldestAge.Seconds())
+}
+
+func (m *PrometheusMetrics) SetLeader(isLeader bool) {
+	if isLeader {
+		m.leader.Set(1)
+	} else {
+		m.leader.Set(0)
+	}
+}
+
+func (m *PrometheusMetrics) MessagesPurged(kind string, count int64) {
+	m.purged.WithLabelValues(kind).Add(float64(count))
+}
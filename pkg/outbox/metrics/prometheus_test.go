@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	m, err := NewPrometheusMetrics(registry)
+	require.NoError(t, err)
+
+	m.MessageEnqueued("orders.created")
+	m.MessageEnqueued("orders.created")
+	m.MessagePublished("orders.created", 50*time.Millisecond)
+	m.MessageFailed("orders.created")
+	m.MessageDeadLettered("orders.created")
+	m.MessageExpired("quotes.created")
+	m.BatchProcessed(10 * time.Millisecond)
+	m.SetBacklog(7, 3*time.Second)
+	m.SetLeader(true)
+	m.MessagesPurged("completed", 100)
+	m.MessagesPurged("completed", 20)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.enqueued.WithLabelValues("orders.created")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.published.WithLabelValues("orders.created")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.failed.WithLabelValues("orders.created")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.deadLettered.WithLabelValues("orders.created")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.expired.WithLabelValues("quotes.created")))
+	assert.Equal(t, 7.0, testutil.ToFloat64(m.pending))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.oldestPending))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.leader))
+	assert.Equal(t, 120.0, testutil.ToFloat64(m.purged.WithLabelValues("completed")))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.publishLatency))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.batchDuration))
+
+	m.SetLeader(false)
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.leader))
+
+	// Registering the collectors twice is reported instead of panicking
+	_, err = NewPrometheusMetrics(registry)
+	assert.Error(t, err)
+}
@@ -0,0 +1,284 @@
+package migration
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+)
+
+//go:embed sql/*.sql
+var migrationFiles embed.FS
+
+// Migration is a single versioned change to the outbox schema
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Migrations returns the embedded migrations for the given tables ordered by version
+func Migrations(tables config.TableConfig) ([]Migration, error) {
+	if err := tables.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid table configuration: %w", err)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	data := newTemplateData(tables)
+	for i, migration := range migrations {
+		tmpl, err := template.New(migration.Name).Parse(migration.SQL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse migration %s: %w", migration.Name, err)
+		}
+
+		var sql strings.Builder
+		if err := tmpl.Execute(&sql, data); err != nil {
+			return nil, fmt.Errorf("failed to render migration %s: %w", migration.Name, err)
+		}
+		migrations[i].SQL = sql.String()
+	}
+
+	return migrations, nil
+}
+
+// loadMigrations reads the embedded migration templates ordered by version
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "sql")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, _, found := strings.Cut(name, "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", entry.Name())
+		}
+
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %w", entry.Name(), err)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("sql", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name,
+			SQL:     string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// LatestVersion returns the version the schema is at once all migrations are applied
+func LatestVersion() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// Migrate creates the outbox tables or upgrades them to the latest version. All pending
+// migrations are applied in a single transaction, and concurrent calls from several
+// instances are serialized with an advisory lock, so it is safe to run on every startup.
+func Migrate(ctx context.Context, db *pgxpool.Pool, tables config.TableConfig) error {
+	migrations, err := Migrations(tables)
+	if err != nil {
+		return err
+	}
+
+	versionTable := tables.Table(tables.Migrations)
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", versionTable); err != nil {
+		return fmt.Errorf("failed to lock schema migrations: %w", err)
+	}
+
+	if tables.Schema != "" {
+		if _, err := tx.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+pgx.Identifier{tables.Schema}.Sanitize()); err != nil {
+			return fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			version INT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		)
+	`, versionTable))
+	if err != nil {
+		return fmt.Errorf("failed to create schema version table: %w", err)
+	}
+
+	current, err := currentVersion(ctx, tx, versionTable)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		if _, err := tx.Exec(ctx, migration.SQL); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", migration.Name, err)
+		}
+
+		_, err := tx.Exec(ctx,
+			fmt.Sprintf("INSERT INTO %s (version, name) VALUES ($1, $2)", versionTable),
+			migration.Version, migration.Name,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record migration %s: %w", migration.Name, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit migrations: %w", err)
+	}
+
+	return nil
+}
+
+// CurrentVersion returns the version of the outbox schema in the database, 0 if it was never migrated
+func CurrentVersion(ctx context.Context, db *pgxpool.Pool, tables config.TableConfig) (int, error) {
+	if err := tables.Validate(); err != nil {
+		return 0, fmt.Errorf("invalid table configuration: %w", err)
+	}
+
+	versionTable := tables.Table(tables.Migrations)
+
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", versionTable).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to check schema version table: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	return currentVersion(ctx, db, versionTable)
+}
+
+// Verify returns an error if the outbox schema in the database is older than the library expects
+func Verify(ctx context.Context, db *pgxpool.Pool, tables config.TableConfig) error {
+	latest, err := LatestVersion()
+	if err != nil {
+		return err
+	}
+
+	current, err := CurrentVersion(ctx, db, tables)
+	if err != nil {
+		return err
+	}
+
+	if current < latest {
+		return fmt.Errorf("outbox schema is at version %d, expected %d: run migrations first", current, latest)
+	}
+
+	return nil
+}
+
+// querier is implemented by both pools and transactions
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func currentVersion(ctx context.Context, q querier, versionTable string) (int, error) {
+	var version int
+	err := q.QueryRow(ctx, fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", versionTable)).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	return version, nil
+}
+
+// templateData exposes the quoted table names to the migration templates
+type templateData struct {
+	Messages        string
+	DeadLetters     string
+	LeaderElection  string
+	Archive         string
+	IdempotencyKeys string
+
+	messagesName        string
+	deadLettersName     string
+	archiveName         string
+	idempotencyKeysName string
+}
+
+func newTemplateData(tables config.TableConfig) templateData {
+	return templateData{
+		Messages:            tables.Table(tables.Messages),
+		DeadLetters:         tables.Table(tables.DeadLetters),
+		LeaderElection:      tables.Table(tables.LeaderElection),
+		Archive:             tables.Table(tables.Archive),
+		IdempotencyKeys:     tables.Table(tables.IdempotencyKeys),
+		messagesName:        tables.Messages,
+		deadLettersName:     tables.DeadLetters,
+		archiveName:         tables.Archive,
+		idempotencyKeysName: tables.IdempotencyKeys,
+	}
+}
+
+// MessagesIndex names an index of the messages table. Index names are unique per schema,
+// so they are derived from the table name to let several outboxes share a schema.
+func (d templateData) MessagesIndex(suffix string) string {
+	return pgx.Identifier{"idx_" + d.messagesName + "_" + suffix}.Sanitize()
+}
+
+// DeadLettersIndex names an index of the dead letters table
+func (d templateData) DeadLettersIndex(suffix string) string {
+	return pgx.Identifier{"idx_" + d.deadLettersName + "_" + suffix}.Sanitize()
+}
+
+// ArchiveIndex names an index of the archive table
+func (d templateData) ArchiveIndex(suffix string) string {
+	return pgx.Identifier{"idx_" + d.archiveName + "_" + suffix}.Sanitize()
+}
+
+// IdempotencyKeysIndex names an index of the idempotency keys table
+func (d templateData) IdempotencyKeysIndex(suffix string) string {
+	return pgx.Identifier{"idx_" + d.idempotencyKeysName + "_" + suffix}.Sanitize()
+}
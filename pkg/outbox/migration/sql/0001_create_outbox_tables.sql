@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS {{.Messages}} (
+    id UUID PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    processed_at TIMESTAMP WITH TIME ZONE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    retry_count INT NOT NULL DEFAULT 0,
+    error TEXT,
+    sequence_number BIGSERIAL NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "status"}} ON {{.Messages}}(status);
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "created_at"}} ON {{.Messages}}(created_at);
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "sequence_number"}} ON {{.Messages}}(sequence_number);
+
+CREATE TABLE IF NOT EXISTS {{.LeaderElection}} (
+    id TEXT PRIMARY KEY,
+    instance_id TEXT NOT NULL,
+    last_heartbeat TIMESTAMP WITH TIME ZONE NOT NULL
+);
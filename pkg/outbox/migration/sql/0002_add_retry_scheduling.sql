@@ -0,0 +1,3 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "next_attempt_at"}} ON {{.Messages}}(next_attempt_at) WHERE status = 'pending';
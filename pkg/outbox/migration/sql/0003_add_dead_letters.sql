@@ -0,0 +1,15 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS error_history JSONB NOT NULL DEFAULT '[]'::jsonb;
+
+CREATE TABLE IF NOT EXISTS {{.DeadLetters}} (
+    id UUID PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    dead_lettered_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    retry_count INT NOT NULL DEFAULT 0,
+    error TEXT,
+    error_history JSONB NOT NULL DEFAULT '[]'::jsonb,
+    sequence_number BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS {{.DeadLettersIndex "dead_lettered_at"}} ON {{.DeadLetters}}(dead_lettered_at);
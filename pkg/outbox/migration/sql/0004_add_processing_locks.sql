@@ -0,0 +1,4 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS locked_by TEXT;
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "locked_until"}} ON {{.Messages}}(locked_until) WHERE status = 'processing';
@@ -0,0 +1,4 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS partition_key TEXT;
+ALTER TABLE {{.DeadLetters}} ADD COLUMN IF NOT EXISTS partition_key TEXT;
+
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "partition_key"}} ON {{.Messages}}(partition_key, sequence_number) WHERE status IN ('pending', 'processing');
@@ -0,0 +1,2 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE {{.DeadLetters}} ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'::jsonb;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "processed_at"}} ON {{.Messages}}(processed_at) WHERE status = 'completed';
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "failed_created_at"}} ON {{.Messages}}(created_at) WHERE status = 'failed';
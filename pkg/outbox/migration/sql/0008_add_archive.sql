@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS {{.Archive}} (
+    id UUID PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    processed_at TIMESTAMP WITH TIME ZONE,
+    status VARCHAR(20) NOT NULL,
+    retry_count INT NOT NULL DEFAULT 0,
+    error TEXT,
+    sequence_number BIGINT NOT NULL,
+    next_attempt_at TIMESTAMP WITH TIME ZONE,
+    error_history JSONB NOT NULL DEFAULT '[]'::jsonb,
+    locked_by TEXT,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    partition_key TEXT,
+    headers JSONB NOT NULL DEFAULT '{}'::jsonb
+);
+
+CREATE INDEX IF NOT EXISTS {{.ArchiveIndex "created_at"}} ON {{.Archive}}(created_at);
+CREATE INDEX IF NOT EXISTS {{.ArchiveIndex "topic_created_at"}} ON {{.Archive}}(topic, created_at);
@@ -0,0 +1,5 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+ALTER TABLE {{.DeadLetters}} ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+ALTER TABLE {{.Archive}} ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS {{.MessagesIndex "idempotency_key"}} ON {{.Messages}}(idempotency_key);
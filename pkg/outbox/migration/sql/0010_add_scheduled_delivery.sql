@@ -0,0 +1,5 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS available_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE {{.DeadLetters}} ADD COLUMN IF NOT EXISTS available_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE {{.Archive}} ADD COLUMN IF NOT EXISTS available_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "available_at"}} ON {{.Messages}}(available_at) WHERE status = 'pending';
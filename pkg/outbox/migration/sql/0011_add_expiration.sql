@@ -0,0 +1,5 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE {{.DeadLetters}} ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE {{.Archive}} ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "expired_created_at"}} ON {{.Messages}}(created_at) WHERE status = 'expired';
@@ -0,0 +1,5 @@
+ALTER TABLE {{.Messages}} ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;
+ALTER TABLE {{.DeadLetters}} ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;
+ALTER TABLE {{.Archive}} ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS {{.MessagesIndex "priority"}} ON {{.Messages}}(priority DESC, sequence_number) WHERE status = 'pending';
@@ -0,0 +1 @@
+ALTER TABLE {{.LeaderElection}} ADD COLUMN IF NOT EXISTS epoch BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS {{.IdempotencyKeys}} (
+    idempotency_key TEXT PRIMARY KEY,
+    message_id UUID NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS {{.IdempotencyKeysIndex "created_at"}} ON {{.IdempotencyKeys}}(created_at);
+
+INSERT INTO {{.IdempotencyKeys}} (idempotency_key, message_id, created_at)
+SELECT idempotency_key, id, created_at FROM {{.Messages}} WHERE idempotency_key IS NOT NULL
+UNION ALL
+SELECT idempotency_key, id, created_at FROM {{.DeadLetters}} WHERE idempotency_key IS NOT NULL
+UNION ALL
+SELECT idempotency_key, id, created_at FROM {{.Archive}} WHERE idempotency_key IS NOT NULL
+ON CONFLICT (idempotency_key) DO NOTHING;
+
+DROP INDEX IF EXISTS {{.MessagesIndex "idempotency_key"}};
@@ -0,0 +1,3 @@
+UPDATE {{.Messages}}
+SET status = 'pending', next_attempt_at = NULL, locked_by = NULL, locked_until = NULL
+WHERE status = 'failed';
@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// ArchiveQuery selects archived messages. Zero values don't restrict the result.
+type ArchiveQuery struct {
+	Topic  string    // Only messages published to this topic
+	From   time.Time // Only messages enqueued at or after this time
+	To     time.Time // Only messages enqueued before this time
+	Limit  int       // Max number of messages returned, 100 if zero
+	Offset int       // Number of matching messages skipped
+}
@@ -0,0 +1,27 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeadLetter is an outbox message that exhausted its retries
+type DeadLetter struct {
+	ID             uuid.UUID         `json:"id"`
+	Topic          string            `json:"topic"`
+	Payload        json.RawMessage   `json:"payload"`
+	CreatedAt      time.Time         `json:"created_at"`
+	DeadLetteredAt time.Time         `json:"dead_lettered_at"`
+	RetryCount     int               `json:"retry_count"`
+	Error          *string           `json:"error"`
+	ErrorHistory   []ErrorRecord     `json:"error_history"`
+	SequenceNumber int64             `json:"sequence_number"`
+	PartitionKey   *string           `json:"partition_key"`
+	Headers        map[string]string `json:"headers"`
+	IdempotencyKey *string           `json:"idempotency_key"`
+	AvailableAt    time.Time         `json:"available_at"`
+	ExpiresAt      *time.Time        `json:"expires_at"`
+	Priority       int               `json:"priority"`
+}
@@ -13,7 +13,8 @@ const (
 	StatusPending    OutboxMessageStatus = "pending"    // Message waiting to be processed
 	StatusProcessing OutboxMessageStatus = "processing" // Message being processed
 	StatusCompleted  OutboxMessageStatus = "completed"  // Message successfully processed
-	StatusFailed     OutboxMessageStatus = "failed"     // Message processing failed
+	StatusFailed     OutboxMessageStatus = "failed"     // Message processing failed and retries are exhausted
+	StatusExpired    OutboxMessageStatus = "expired"    // Message expired before it could be published
 )
 
 type OutboxMessage struct {
@@ -26,6 +27,29 @@ type OutboxMessage struct {
 	RetryCount     int                 `json:"retry_count"`
 	Error          *string             `json:"error"`
 	SequenceNumber int64               `json:"sequence_number"`
+	NextAttemptAt  *time.Time          `json:"next_attempt_at"`
+	ErrorHistory   []ErrorRecord       `json:"error_history"`
+	LockedBy       *string             `json:"locked_by"`       // Instance that claimed the message for processing
+	LockedUntil    *time.Time          `json:"locked_until"`    // When the claim expires and the message can be recovered
+	PartitionKey   *string             `json:"partition_key"`   // Messages with the same key are delivered in sequence order
+	Headers        map[string]string   `json:"headers"`         // Metadata published alongside the payload
+	IdempotencyKey *string             `json:"idempotency_key"` // At most one message is enqueued with the key
+	AvailableAt    time.Time           `json:"available_at"`    // The message is not published before this time, by default when it is stored
+	DeliveryDelay  time.Duration       `json:"-"`               // Defers a message without AvailableAt by this long after it is stored
+	ExpiresAt      *time.Time          `json:"expires_at"`      // The message is discarded instead of published after this time
+	Priority       int                 `json:"priority"`        // Messages with a higher priority are published first
+}
+
+// Expired reports whether the message can no longer be published at the given time
+func (m *OutboxMessage) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// ErrorRecord describes a single failed delivery attempt
+type ErrorRecord struct {
+	Attempt  int       `json:"attempt"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
 }
 
 func NewOutboxMessage(topic string, payload interface{}) (*OutboxMessage, error) {
@@ -34,12 +58,20 @@ func NewOutboxMessage(topic string, payload interface{}) (*OutboxMessage, error)
 		return nil, err
 	}
 
+	now := time.Now().UTC()
+
 	return &OutboxMessage{
 		ID:         uuid.New(),
 		Topic:      topic,
 		Payload:    payloadBytes,
-		CreatedAt:  time.Now().UTC(),
+		CreatedAt:  now,
 		Status:     StatusPending,
 		RetryCount: 0,
 	}, nil
 }
+
+// BacklogStats describes the messages that are waiting to be published
+type BacklogStats struct {
+	Pending         int64      `json:"pending"`
+	OldestCreatedAt *time.Time `json:"oldest_created_at"`
+}
@@ -0,0 +1,146 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
+)
+
+// EnqueueOption customizes how a single message is enqueued
+type EnqueueOption func(*enqueueOptions)
+
+type enqueueOptions struct {
+	partitionKey    *string
+	headers         map[string]string
+	idempotencyKey  *string
+	ignoreDuplicate bool
+	deliverAt       time.Time
+	deliverAfter    time.Duration
+	expiresAt       time.Time
+	ttl             time.Duration
+	priority        int
+}
+
+// WithPartitionKey assigns the message to an ordering partition. Messages sharing a key are
+// published strictly in enqueue order, while messages with different keys are published concurrently.
+func WithPartitionKey(key string) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.partitionKey = &key
+	}
+}
+
+// WithHeader adds a header that is published alongside the message payload,
+// e.g. a correlation ID, tenant ID or content type
+func WithHeader(key, value string) EnqueueOption {
+	return func(o *enqueueOptions) {
+		if o.headers == nil {
+			o.headers = make(map[string]string)
+		}
+		o.headers[key] = value
+	}
+}
+
+// WithHeaders adds headers that are published alongside the message payload
+func WithHeaders(headers map[string]string) EnqueueOption {
+	return func(o *enqueueOptions) {
+		for key, value := range headers {
+			WithHeader(key, value)(o)
+		}
+	}
+}
+
+// WithIdempotencyKey stores the message only if no message with the same key was enqueued before,
+// even if that message was since published, archived or dead-lettered. Keys are remembered for
+// the idempotency key retention, forever by default. Enqueuing a duplicate returns
+// ErrDuplicateMessage unless IgnoreDuplicate is also given, and in both cases leaves the
+// transaction usable so the caller can decide whether to commit.
+func WithIdempotencyKey(key string) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.idempotencyKey = &key
+	}
+}
+
+// IgnoreDuplicate makes enqueuing a message with the idempotency key of a message
+// enqueued before succeed without storing it
+func IgnoreDuplicate() EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.ignoreDuplicate = true
+	}
+}
+
+// DeliverAt commits the message with the transaction but publishes it no earlier than the given time
+func DeliverAt(t time.Time) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.deliverAt = t
+		o.deliverAfter = 0
+	}
+}
+
+// DeliverAfter commits the message with the transaction but publishes it no earlier than
+// the given delay after it was enqueued
+func DeliverAfter(delay time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.deliverAfter = delay
+		o.deliverAt = time.Time{}
+	}
+}
+
+// WithExpiration discards the message instead of publishing it if it could not be published
+// before the given time, e.g. because the broker was unavailable
+func WithExpiration(t time.Time) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.expiresAt = t
+		o.ttl = 0
+	}
+}
+
+// WithTTL discards the message instead of publishing it if it could not be published
+// within the given time after it was enqueued
+func WithTTL(ttl time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.ttl = ttl
+		o.expiresAt = time.Time{}
+	}
+}
+
+// WithPriority publishes the message ahead of waiting messages with a lower priority. The default
+// priority is 0; negative priorities suit bulk work such as backfills. Messages sharing a
+// partition key are still published in enqueue order regardless of their priority.
+func WithPriority(priority int) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.priority = priority
+	}
+}
+
+func newEnqueueOptions(opts []EnqueueOption) enqueueOptions {
+	var options enqueueOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// apply copies the options onto a message before it is stored
+func (o enqueueOptions) apply(msg *model.OutboxMessage) {
+	msg.PartitionKey = o.partitionKey
+	msg.Headers = o.headers
+	msg.IdempotencyKey = o.idempotencyKey
+	msg.Priority = o.priority
+
+	switch {
+	case !o.deliverAt.IsZero():
+		msg.AvailableAt = o.deliverAt.UTC()
+	case o.deliverAfter > 0:
+		// The delay starts when the database stores the message, so it does not depend on the app clock
+		msg.DeliveryDelay = o.deliverAfter
+	}
+
+	switch {
+	case !o.expiresAt.IsZero():
+		expiresAt := o.expiresAt.UTC()
+		msg.ExpiresAt = &expiresAt
+	case o.ttl > 0:
+		expiresAt := msg.CreatedAt.Add(o.ttl)
+		msg.ExpiresAt = &expiresAt
+	}
+}
@@ -0,0 +1,88 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
+)
+
+func TestEnqueueOptions(t *testing.T) {
+	msg, err := model.NewOutboxMessage("test.topic", map[string]interface{}{
+		"key": "value",
+	})
+	require.NoError(t, err)
+
+	options := newEnqueueOptions([]EnqueueOption{
+		WithPartitionKey("order-1"),
+		WithHeader("Correlation-Id", "abc"),
+		WithHeaders(map[string]string{"Tenant-Id": "acme"}),
+		WithIdempotencyKey("order-created:1"),
+		WithPriority(10),
+	})
+	options.apply(msg)
+
+	require.NotNil(t, msg.PartitionKey)
+	assert.Equal(t, "order-1", *msg.PartitionKey)
+	assert.Equal(t, map[string]string{"Correlation-Id": "abc", "Tenant-Id": "acme"}, msg.Headers)
+	require.NotNil(t, msg.IdempotencyKey)
+	assert.Equal(t, "order-created:1", *msg.IdempotencyKey)
+	assert.False(t, options.ignoreDuplicate)
+	assert.Equal(t, 10, msg.Priority)
+
+	assert.True(t, newEnqueueOptions([]EnqueueOption{IgnoreDuplicate()}).ignoreDuplicate)
+	// Messages are available once stored unless they are scheduled
+	assert.True(t, msg.AvailableAt.IsZero())
+	assert.Zero(t, msg.DeliveryDelay)
+}
+
+func TestScheduledDeliveryOptions(t *testing.T) {
+	msg, err := model.NewOutboxMessage("test.topic", map[string]interface{}{
+		"key": "value",
+	})
+	require.NoError(t, err)
+
+	// Delays are left to the database clock
+	newEnqueueOptions([]EnqueueOption{DeliverAfter(30 * time.Minute)}).apply(msg)
+	assert.Equal(t, 30*time.Minute, msg.DeliveryDelay)
+	assert.True(t, msg.AvailableAt.IsZero())
+
+	msg, err = model.NewOutboxMessage("test.topic", map[string]interface{}{
+		"key": "value",
+	})
+	require.NoError(t, err)
+	deliverAt := time.Date(2030, 1, 1, 9, 0, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+	newEnqueueOptions([]EnqueueOption{DeliverAt(deliverAt)}).apply(msg)
+	assert.True(t, deliverAt.Equal(msg.AvailableAt))
+	assert.Equal(t, time.UTC, msg.AvailableAt.Location())
+	assert.Zero(t, msg.DeliveryDelay)
+
+	// The last scheduling option wins
+	options := newEnqueueOptions([]EnqueueOption{DeliverAt(deliverAt), DeliverAfter(time.Minute)})
+	assert.True(t, options.deliverAt.IsZero())
+	assert.Equal(t, time.Minute, options.deliverAfter)
+}
+
+func TestExpirationOptions(t *testing.T) {
+	msg, err := model.NewOutboxMessage("test.topic", map[string]interface{}{
+		"key": "value",
+	})
+	require.NoError(t, err)
+
+	newEnqueueOptions(nil).apply(msg)
+	assert.Nil(t, msg.ExpiresAt)
+
+	newEnqueueOptions([]EnqueueOption{WithTTL(5 * time.Minute)}).apply(msg)
+	require.NotNil(t, msg.ExpiresAt)
+	assert.Equal(t, msg.CreatedAt.Add(5*time.Minute), *msg.ExpiresAt)
+	assert.False(t, msg.Expired(msg.CreatedAt))
+	assert.True(t, msg.Expired(msg.CreatedAt.Add(5*time.Minute)))
+
+	expiresAt := time.Date(2030, 1, 1, 9, 0, 0, 0, time.UTC)
+	newEnqueueOptions([]EnqueueOption{WithExpiration(expiresAt)}).apply(msg)
+	require.NotNil(t, msg.ExpiresAt)
+	assert.Equal(t, expiresAt, *msg.ExpiresAt)
+}
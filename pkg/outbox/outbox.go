@@ -2,42 +2,163 @@ package outbox
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 
 	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/metrics"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/migration"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/processor"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/publisher"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/repository"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/tracing"
+)
+
+// ErrDuplicateMessage is returned by EnqueueMessage when a message with the same
+// idempotency key was enqueued within the idempotency key retention
+var ErrDuplicateMessage = repository.ErrDuplicateMessage
+
+// LeadershipEvent describes a change of leadership of this instance
+type LeadershipEvent = processor.LeadershipEvent
+
+// Types of leadership events
+const (
+	LeadershipAcquired = processor.LeadershipAcquired
+	LeadershipRenewed  = processor.LeadershipRenewed
+	LeadershipLost     = processor.LeadershipLost
 )
 
 type Outbox struct {
-	repo      repository.Repository
-	publisher publisher.Publisher
-	processor *processor.Processor
+	repo           repository.Repository
+	publisher      publisher.Publisher
+	leaderElection processor.LeaderElection
+	processor      *processor.Processor
+	metrics        metrics.Metrics
+}
+
+// Migrate creates the tables of the configured outbox or upgrades them to the schema version this
+// library expects. It is idempotent and safe to call concurrently from several instances.
+func Migrate(ctx context.Context, cfg config.OutboxConfig) error {
+	return migration.Migrate(ctx, cfg.DB, cfg.Tables)
 }
 
 // New creates a new outbox instance
 func New(cfg config.OutboxConfig) (*Outbox, error) {
-	repo := repository.NewPostgresRepository(cfg.DB)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
-	pub, err := publisher.NewNatsPublisher(cfg.NatsURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create NATS publisher: %w", err)
+	if cfg.VerifySchema {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := migration.Verify(ctx, cfg.DB, cfg.Tables); err != nil {
+			return nil, fmt.Errorf("failed to verify outbox schema: %w", err)
+		}
+	}
+
+	repoOpts := []repository.Option{
+		repository.WithTables(cfg.Tables),
+		repository.WithPriorityAging(cfg.ProcessorConfig.PriorityAging),
+		repository.WithFairShare(cfg.ProcessorConfig.FairShare),
+	}
+	if cfg.Archive {
+		repoOpts = append(repoOpts, repository.WithArchive())
+	}
+	var procOpts []processor.Option
+
+	m := cfg.Metrics
+	if m == nil {
+		m = metrics.NoopMetrics{}
+	} else {
+		procOpts = append(procOpts, processor.WithMetrics(m))
 	}
 
-	leaderElection := processor.NewDatabaseLeaderElection(cfg.DB, cfg.InstanceID)
-	proc := processor.NewProcessor(repo, pub, leaderElection, cfg.ProcessorConfig)
+	if channel := notifyChannel(cfg); channel != "" {
+		repoOpts = append(repoOpts, repository.WithNotifyChannel(channel))
+		procOpts = append(procOpts, processor.WithNotifier(processor.NewPostgresNotifier(cfg.DB, channel)))
+	}
+
+	if cfg.TracerProvider != nil {
+		procOpts = append(procOpts, processor.WithTracerProvider(cfg.TracerProvider))
+	}
+
+	repo := repository.NewPostgresRepository(cfg.DB, repoOpts...)
+
+	var leaderElection processor.LeaderElection
+	switch cfg.ProcessorConfig.Mode {
+	case config.ModeCompetingConsumers:
+		leaderElection = processor.NewStandaloneLeaderElection(cfg.InstanceID)
+	case config.ModeLeaderElection, "":
+		le, err := newLeaderElection(cfg)
+		if err != nil {
+			return nil, err
+		}
+		leaderElection = le
+	default:
+		return nil, fmt.Errorf("unknown processing mode: %q", cfg.ProcessorConfig.Mode)
+	}
+
+	var pub publisher.Publisher
+	if cfg.JetStream != nil {
+		jsPub, err := publisher.NewJetStreamPublisher(cfg.NatsURL, *cfg.JetStream)
+		if err != nil {
+			leaderElection.Stop()
+			return nil, fmt.Errorf("failed to create JetStream publisher: %w", err)
+		}
+		pub = jsPub
+	} else {
+		natsPub, err := publisher.NewNatsPublisher(cfg.NatsURL)
+		if err != nil {
+			leaderElection.Stop()
+			return nil, fmt.Errorf("failed to create NATS publisher: %w", err)
+		}
+		pub = natsPub
+	}
+
+	proc := processor.NewProcessor(repo, pub, leaderElection, cfg.InstanceID, cfg.ProcessorConfig, procOpts...)
 
 	return &Outbox{
-		repo:      repo,
-		publisher: pub,
-		processor: proc,
+		repo:           repo,
+		publisher:      pub,
+		leaderElection: leaderElection,
+		processor:      proc,
+		metrics:        m,
 	}, nil
 }
 
+// newLeaderElection creates the leader election of the configured backend
+func newLeaderElection(cfg config.OutboxConfig) (processor.LeaderElection, error) {
+	switch cfg.LeaderElection.Backend {
+	case config.LeaderElectionAdvisoryLock:
+		return processor.NewAdvisoryLockLeaderElection(cfg.DB, cfg.InstanceID, cfg.Tables, cfg.LeaderElection), nil
+	case config.LeaderElectionNatsKV:
+		le, err := processor.NewNatsKVLeaderElection(cfg.NatsURL, cfg.DB, cfg.InstanceID, cfg.Tables, cfg.LeaderElection)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create NATS KV leader election: %w", err)
+		}
+		return le, nil
+	default:
+		return processor.NewDatabaseLeaderElection(cfg.DB, cfg.InstanceID,
+			processor.WithLeaderElectionTables(cfg.Tables),
+			processor.WithLeaderElectionConfig(cfg.LeaderElection),
+		), nil
+	}
+}
+
+// notifyChannel keeps outboxes with custom tables from waking each other up on the default channel
+func notifyChannel(cfg config.OutboxConfig) string {
+	if cfg.ProcessorConfig.NotifyChannel == config.DefaultNotifyChannel {
+		return cfg.Tables.NotifyChannel()
+	}
+	return cfg.ProcessorConfig.NotifyChannel
+}
+
 func (o *Outbox) Start(ctx context.Context) error {
 	return o.processor.Start(ctx)
 }
@@ -46,17 +167,59 @@ func (o *Outbox) Stop() error {
 	return o.processor.Stop()
 }
 
+// OnLeadershipChange registers a callback that is notified when this instance acquires, renews or
+// loses leadership. Callbacks are called in order from the leader election and must return quickly.
+// In competing consumers mode every instance acquires leadership on Start and loses it on Stop.
+func (o *Outbox) OnLeadershipChange(fn func(LeadershipEvent)) {
+	o.leaderElection.OnLeadershipChange(fn)
+}
+
 // EnqueueMessage stores a message to be published after transaction commit
-// The message is stored in the outbox table as part of the transaction
-func (o *Outbox) EnqueueMessage(ctx context.Context, tx pgx.Tx, topic string, payload interface{}) error {
+// The message is stored in the outbox table as part of the transaction, together with
+// the trace context of ctx so consumers can continue the trace
+func (o *Outbox) EnqueueMessage(ctx context.Context, tx pgx.Tx, topic string, payload interface{}, opts ...EnqueueOption) error {
 	msg, err := model.NewOutboxMessage(topic, payload)
 	if err != nil {
 		return fmt.Errorf("failed to create outbox message: %w", err)
 	}
 
+	options := newEnqueueOptions(opts)
+	options.apply(msg)
+	msg.Headers = tracing.Inject(ctx, msg.Headers)
+
 	if err := o.repo.EnqueueMessage(ctx, tx, msg); err != nil {
+		if errors.Is(err, ErrDuplicateMessage) && options.ignoreDuplicate {
+			return nil
+		}
 		return fmt.Errorf("failed to enqueue message: %w", err)
 	}
 
+	o.metrics.MessageEnqueued(topic)
+
 	return nil
 }
+
+// ListDeadLetters returns messages that exhausted their retries, most recent first
+func (o *Outbox) ListDeadLetters(ctx context.Context, limit, offset int) ([]*model.DeadLetter, error) {
+	return o.repo.ListDeadLetters(ctx, limit, offset)
+}
+
+// RequeueDeadLetter returns a dead letter to the outbox so it is published again
+func (o *Outbox) RequeueDeadLetter(ctx context.Context, id uuid.UUID) error {
+	return o.repo.RequeueDeadLetter(ctx, id)
+}
+
+// DiscardDeadLetter permanently deletes a dead letter
+func (o *Outbox) DiscardDeadLetter(ctx context.Context, id uuid.UUID) error {
+	return o.repo.DiscardDeadLetter(ctx, id)
+}
+
+// GetArchivedMessage returns a completed message from the archive
+func (o *Outbox) GetArchivedMessage(ctx context.Context, id uuid.UUID) (*model.OutboxMessage, error) {
+	return o.repo.GetArchivedMessage(ctx, id)
+}
+
+// FindArchivedMessages returns completed messages from the archive that match the query
+func (o *Outbox) FindArchivedMessages(ctx context.Context, query model.ArchiveQuery) ([]*model.OutboxMessage, error) {
+	return o.repo.FindArchivedMessages(ctx, query)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/publisher"
 )
 
 // TestOutbox requires running PostgreSQL and NATS instances.
@@ -29,6 +30,8 @@ func TestOutbox(t *testing.T) {
 	}
 	defer dbPool.Close()
 
+	require.NoError(t, Migrate(ctx, config.NewOutboxConfig(dbPool, natsURL, "test-instance")))
+
 	// Clean up the outbox_messages table
 	_, err = dbPool.Exec(ctx, "DELETE FROM outbox_messages")
 	require.NoError(t, err)
@@ -40,11 +43,11 @@ func TestOutbox(t *testing.T) {
 	}
 	defer nc.Close()
 
-	msgCh := make(chan []byte, 1)
+	msgCh := make(chan *nats.Msg, 1)
 
 	// Subscribe to the test topic
 	sub, err := nc.Subscribe("test.topic", func(msg *nats.Msg) {
-		msgCh <- msg.Data
+		msgCh <- msg
 	})
 	require.NoError(t, err)
 	defer sub.Unsubscribe()
@@ -86,7 +89,7 @@ func TestOutbox(t *testing.T) {
 	defer tx.Rollback(ctx)
 
 	// Enqueue the message
-	err = outboxService.EnqueueMessage(ctx, tx, "test.topic", testMsg)
+	err = outboxService.EnqueueMessage(ctx, tx, "test.topic", testMsg, WithHeader("Correlation-Id", "test-correlation-id"))
 	require.NoError(t, err)
 
 	// Commit the transaction
@@ -95,15 +98,20 @@ func TestOutbox(t *testing.T) {
 
 	// Wait for the message to be received
 	select {
-	case receivedData := <-msgCh:
+	case received := <-msgCh:
 		var receivedMsg TestMessage
-		err := json.Unmarshal(receivedData, &receivedMsg)
+		err := json.Unmarshal(received.Data, &receivedMsg)
 		require.NoError(t, err)
 
 		// Verify the message
 		assert.Equal(t, testMsg.ID, receivedMsg.ID)
 		assert.Equal(t, testMsg.Key, receivedMsg.Key)
 		assert.Equal(t, testMsg.Value, receivedMsg.Value)
+
+		// Verify the headers
+		assert.Equal(t, "test-correlation-id", received.Header.Get("Correlation-Id"))
+		assert.NotEmpty(t, received.Header.Get(publisher.HeaderMessageID))
+		assert.NotEmpty(t, received.Header.Get(publisher.HeaderSequence))
 	case <-time.After(5 * time.Second):
 		t.Fatal("Timed out waiting for message")
 	}
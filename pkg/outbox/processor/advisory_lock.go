@@ -0,0 +1,158 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+)
+
+// AdvisoryLockLeaderElection elects the instance holding a PostgreSQL session advisory lock.
+// A leader whose session was dropped leads until its lease expires, so writes are fenced by epoch.
+type AdvisoryLockLeaderElection struct {
+	leadership
+	db        *pgxpool.Pool
+	table     string
+	leaderKey string
+	lockName  string
+	config    config.LeaderElectionConfig
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewAdvisoryLockLeaderElection creates a leader election locking on the leader row named by tables
+func NewAdvisoryLockLeaderElection(
+	db *pgxpool.Pool,
+	instanceID string,
+	tables config.TableConfig,
+	cfg config.LeaderElectionConfig,
+) *AdvisoryLockLeaderElection {
+	return &AdvisoryLockLeaderElection{
+		leadership: leadership{instanceID: instanceID},
+		db:         db,
+		table:      tables.Table(tables.LeaderElection),
+		leaderKey:  tables.LeaderKey,
+		lockName:   tables.Table(tables.LeaderElection) + "/" + tables.LeaderKey,
+		config:     cfg,
+	}
+}
+
+func (l *AdvisoryLockLeaderElection) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	l.cancel = cancel
+
+	l.wg.Add(1)
+	go l.campaignLoop(ctx)
+
+	return nil
+}
+
+// Stop gives up leadership by closing the connection that holds the lock
+func (l *AdvisoryLockLeaderElection) Stop() error {
+	if l.cancel != nil {
+		l.cancel()
+	}
+	l.wg.Wait()
+
+	return nil
+}
+
+// campaignLoop keeps a connection open to compete for the lock, reconnecting after failures
+func (l *AdvisoryLockLeaderElection) campaignLoop(ctx context.Context) {
+	defer l.wg.Done()
+
+	for {
+		err := l.campaign(ctx)
+		l.lost()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Advisory lock leader election failed, reconnecting: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.config.RetryInterval):
+		}
+	}
+}
+
+// campaign takes the lock on a dedicated connection and renews the lease while the connection lives
+func (l *AdvisoryLockLeaderElection) campaign(ctx context.Context) error {
+	conn, err := pgx.ConnectConfig(ctx, l.db.Config().ConnConfig)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	held := false
+	var epoch int64
+	for {
+		start := time.Now()
+		if held {
+			if err := l.ping(ctx, conn); err != nil {
+				return fmt.Errorf("lost the connection holding the leader lock: %w", err)
+			}
+			if !l.IsLeader() {
+				return fmt.Errorf("lease expired before it could be renewed")
+			}
+		} else {
+			if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", l.lockName).Scan(&held); err != nil {
+				return fmt.Errorf("failed to try the leader lock: %w", err)
+			}
+			if held {
+				if epoch, err = l.nextEpoch(ctx, conn); err != nil {
+					return err
+				}
+			}
+		}
+
+		interval := l.config.RetryInterval
+		if held {
+			l.renewed(start.Add(l.config.LeaseTTL), epoch)
+			interval = l.config.RenewInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// nextEpoch starts a new leadership term in the leader row. Only the holder of the lock writes the
+// row, so the epoch increases with every change of leader.
+func (l *AdvisoryLockLeaderElection) nextEpoch(ctx context.Context, conn *pgx.Conn) (int64, error) {
+	var epoch int64
+	err := conn.QueryRow(ctx, fmt.Sprintf(`
+		INSERT INTO %s AS le (id, instance_id, last_heartbeat, epoch)
+		VALUES ($1, $2, NOW(), 1)
+		ON CONFLICT (id) DO UPDATE
+		SET instance_id = $2, last_heartbeat = NOW(), epoch = le.epoch + 1
+		RETURNING epoch
+	`, l.table), l.leaderKey, l.instanceID).Scan(&epoch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a leadership epoch: %w", err)
+	}
+
+	return epoch, nil
+}
+
+// ping checks the connection, giving up once the lease expired
+func (l *AdvisoryLockLeaderElection) ping(ctx context.Context, conn *pgx.Conn) error {
+	l.mu.Lock()
+	expiresAt := l.expiresAt
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithDeadline(ctx, expiresAt)
+	defer cancel()
+
+	return conn.Ping(ctx)
+}
@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+)
+
+func TestAdvisoryLockLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	dbPool := testDB(t)
+
+	tables := config.DefaultTableConfig()
+	tables.LeaderKey = "advisory_lock_test"
+
+	newElection := func(instanceID string) *AdvisoryLockLeaderElection {
+		cfg := config.DefaultLeaderElectionConfig()
+		cfg.LeaseTTL = time.Second
+		cfg.RenewInterval = 50 * time.Millisecond
+		cfg.RetryInterval = 50 * time.Millisecond
+		return NewAdvisoryLockLeaderElection(dbPool, instanceID, tables, cfg)
+	}
+
+	first := newElection("first-instance")
+	second := newElection("second-instance")
+
+	require.NoError(t, first.Start(ctx))
+	require.Eventually(t, first.IsLeader, 5*time.Second, 10*time.Millisecond, "first instance should take the lock")
+	firstEpoch := first.Epoch()
+	assert.Positive(t, firstEpoch)
+
+	require.NoError(t, second.Start(ctx))
+	defer second.Stop()
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, second.IsLeader(), "only one session can hold the lock")
+
+	// Stopping the leader closes its session, and with it the lock
+	require.NoError(t, first.Stop())
+	assert.False(t, first.IsLeader())
+	require.Eventually(t, second.IsLeader, 5*time.Second, 10*time.Millisecond, "second instance should take over")
+	assert.Greater(t, second.Epoch(), firstEpoch, "a new leader starts a new epoch")
+
+	// Killing the leader's session makes it step down instead of believing it still leads
+	_, err := dbPool.Exec(ctx, `
+		SELECT pg_terminate_backend(pid)
+		FROM pg_locks
+		WHERE locktype = 'advisory' AND objid = hashtext($1)::oid AND granted
+	`, tables.Table(tables.LeaderElection)+"/"+tables.LeaderKey)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return !second.IsLeader() }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, second.IsLeader, 5*time.Second, 10*time.Millisecond, "leadership is regained after reconnecting")
+}
@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"math/rand"
+	"time"
+)
+
+// retryDelay calculates the delay before the given retry attempt (starting at 1)
+// using exponential backoff capped at maxDelay. Jitter spreads the result over
+// the upper half of the window so that messages failing together don't retry together.
+func retryDelay(attempt int, baseDelay, maxDelay time.Duration) time.Duration {
+	if baseDelay <= 0 {
+		return 0
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	if maxDelay <= 0 || maxDelay < baseDelay {
+		maxDelay = baseDelay
+	}
+
+	delay := baseDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,28 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryDelay(t *testing.T) {
+	base := 100 * time.Millisecond
+	max := time.Second
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		expected := base << (attempt - 1)
+		if expected > max {
+			expected = max
+		}
+
+		delay := retryDelay(attempt, base, max)
+		assert.GreaterOrEqual(t, delay, expected/2, "attempt %d", attempt)
+		assert.LessOrEqual(t, delay, expected, "attempt %d", attempt)
+	}
+}
+
+func TestRetryDelayWithoutBase(t *testing.T) {
+	assert.Equal(t, time.Duration(0), retryDelay(3, 0, time.Second))
+}
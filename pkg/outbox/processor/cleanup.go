@@ -0,0 +1,97 @@
+package processor
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Kinds of rows deleted by the cleanup, as reported to metrics
+const (
+	purgedCompleted      = "completed"
+	purgedFailed         = "failed"
+	purgedExpired        = "expired"
+	purgedDeadLetter     = "dead_letter"
+	purgedIdempotencyKey = "idempotency_key"
+)
+
+// cleanupLoop periodically deletes messages whose retention elapsed, so the outbox
+// tables don't grow without bound
+func (p *Processor) cleanupLoop(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if p.leaderElection.IsLeader() {
+				p.cleanup(ctx)
+			}
+		}
+	}
+}
+
+// cleanup deletes all rows whose retention elapsed
+func (p *Processor) cleanup(ctx context.Context) {
+	now := time.Now()
+
+	if retention := p.config.CompletedRetention; retention > 0 {
+		p.purge(ctx, purgedCompleted, now.Add(-retention), p.repo.DeleteCompletedMessages)
+	}
+
+	if retention := p.config.DeadLetterRetention; retention > 0 {
+		p.purge(ctx, purgedFailed, now.Add(-retention), p.repo.DeleteFailedMessages)
+		p.purge(ctx, purgedExpired, now.Add(-retention), p.repo.DeleteExpiredMessages)
+		p.purge(ctx, purgedDeadLetter, now.Add(-retention), p.repo.DeleteDeadLetters)
+	}
+
+	if retention := p.config.IdempotencyKeyRetention; retention > 0 {
+		p.purge(ctx, purgedIdempotencyKey, now.Add(-retention), p.repo.DeleteIdempotencyKeys)
+	}
+}
+
+// purge deletes rows older than before in batches of CleanupBatchSize, so that no single
+// statement holds locks on a large number of rows, until fewer than a full batch remain
+func (p *Processor) purge(
+	ctx context.Context,
+	kind string,
+	before time.Time,
+	deleteBatch func(ctx context.Context, before time.Time, limit int) (int64, error),
+) {
+	var total int64
+	defer func() {
+		if total > 0 {
+			log.Printf("Purged %d %s messages older than %s", total, kind, before.Format(time.RFC3339))
+		}
+	}()
+
+	for {
+		deleted, err := deleteBatch(ctx, before, p.config.CleanupBatchSize)
+		if err != nil {
+			log.Printf("Error purging %s messages: %v", kind, err)
+			return
+		}
+
+		total += deleted
+		if deleted > 0 {
+			p.metrics.MessagesPurged(kind, deleted)
+		}
+		if deleted < int64(p.config.CleanupBatchSize) {
+			return
+		}
+
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
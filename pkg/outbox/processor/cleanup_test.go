@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/metrics"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/repository"
+)
+
+// cleanupRepository simulates tables holding a number of expired rows of each kind
+type cleanupRepository struct {
+	repository.Repository
+
+	mu      sync.Mutex
+	expired map[string]int64
+	limits  []int
+	cutoffs map[string]time.Time
+}
+
+func (r *cleanupRepository) delete(kind string, before time.Time, limit int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.limits = append(r.limits, limit)
+	r.cutoffs[kind] = before
+
+	deleted := min(r.expired[kind], int64(limit))
+	r.expired[kind] -= deleted
+	return deleted, nil
+}
+
+func (r *cleanupRepository) DeleteCompletedMessages(_ context.Context, before time.Time, limit int) (int64, error) {
+	return r.delete(purgedCompleted, before, limit)
+}
+
+func (r *cleanupRepository) DeleteFailedMessages(_ context.Context, before time.Time, limit int) (int64, error) {
+	return r.delete(purgedFailed, before, limit)
+}
+
+func (r *cleanupRepository) DeleteExpiredMessages(_ context.Context, before time.Time, limit int) (int64, error) {
+	return r.delete(purgedExpired, before, limit)
+}
+
+func (r *cleanupRepository) DeleteDeadLetters(_ context.Context, before time.Time, limit int) (int64, error) {
+	return r.delete(purgedDeadLetter, before, limit)
+}
+
+func (r *cleanupRepository) DeleteIdempotencyKeys(_ context.Context, before time.Time, limit int) (int64, error) {
+	return r.delete(purgedIdempotencyKey, before, limit)
+}
+
+// purgeMetrics records purged rows per kind
+type purgeMetrics struct {
+	metrics.NoopMetrics
+
+	mu     sync.Mutex
+	purged map[string]int64
+}
+
+func (m *purgeMetrics) MessagesPurged(kind string, count int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purged[kind] += count
+}
+
+func TestCleanup(t *testing.T) {
+	repo := &cleanupRepository{
+		expired: map[string]int64{
+			purgedCompleted:      250,
+			purgedFailed:         3,
+			purgedExpired:        0,
+			purgedDeadLetter:     100,
+			purgedIdempotencyKey: 40,
+		},
+		cutoffs: map[string]time.Time{},
+	}
+	m := &purgeMetrics{purged: map[string]int64{}}
+
+	cfg := config.DefaultProcessorConfig()
+	cfg.CompletedRetention = time.Hour
+	cfg.DeadLetterRetention = 24 * time.Hour
+	cfg.IdempotencyKeyRetention = 7 * 24 * time.Hour
+	cfg.CleanupBatchSize = 100
+
+	p := NewProcessor(repo, nil, NewStandaloneLeaderElection("test-instance"), "test-instance", cfg, WithMetrics(m))
+
+	start := time.Now()
+	p.cleanup(context.Background())
+
+	// Everything expired is deleted, in batches no larger than the batch size
+	assert.Equal(t, map[string]int64{purgedCompleted: 0, purgedFailed: 0, purgedExpired: 0, purgedDeadLetter: 0, purgedIdempotencyKey: 0}, repo.expired)
+	assert.Equal(t, map[string]int64{purgedCompleted: 250, purgedFailed: 3, purgedDeadLetter: 100, purgedIdempotencyKey: 40}, m.purged)
+	for _, limit := range repo.limits {
+		assert.Equal(t, 100, limit)
+	}
+	// 3 batches of completed, 1 of failed, 1 of expired, 2 of dead letters since a full batch may be followed by more,
+	// 1 of idempotency keys
+	assert.Len(t, repo.limits, 8)
+
+	assert.WithinDuration(t, start.Add(-time.Hour), repo.cutoffs[purgedCompleted], time.Second)
+	assert.WithinDuration(t, start.Add(-24*time.Hour), repo.cutoffs[purgedFailed], time.Second)
+	assert.WithinDuration(t, start.Add(-24*time.Hour), repo.cutoffs[purgedExpired], time.Second)
+	assert.WithinDuration(t, start.Add(-24*time.Hour), repo.cutoffs[purgedDeadLetter], time.Second)
+	assert.WithinDuration(t, start.Add(-7*24*time.Hour), repo.cutoffs[purgedIdempotencyKey], time.Second)
+}
+
+func TestCleanupWithoutRetention(t *testing.T) {
+	repo := &cleanupRepository{
+		expired: map[string]int64{purgedCompleted: 10},
+		cutoffs: map[string]time.Time{},
+	}
+
+	cfg := config.DefaultProcessorConfig()
+	cfg.DeadLetterRetention = time.Hour
+
+	p := NewProcessor(repo, nil, NewStandaloneLeaderElection("test-instance"), "test-instance", cfg)
+	p.cleanup(context.Background())
+
+	// Completed messages are kept forever without a retention
+	assert.Equal(t, int64(10), repo.expired[purgedCompleted])
+	assert.NotContains(t, repo.cutoffs, purgedCompleted)
+}
@@ -2,12 +2,17 @@ package processor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
 )
 
 // LeaderElection defines the interface for leader election
@@ -16,53 +21,243 @@ type LeaderElection interface {
 	Stop() error
 	// IsLeader checks if the current instance is the leader
 	IsLeader() bool
+	// Epoch returns the fencing token of the current leadership term, which increases with every
+	// change of leader, or 0 if writes are not fenced
+	Epoch() int64
+	// OnLeadershipChange registers a callback that is notified about every leadership event of
+	// the current instance. Callbacks are called one event at a time, in order, from the goroutine
+	// of the leader election, so they must return quickly.
+	OnLeadershipChange(fn func(LeadershipEvent))
 }
 
-type DatabaseLeaderElection struct {
-	db         *pgxpool.Pool
+// LeadershipEventType tells how the leadership of an instance changed
+type LeadershipEventType string
+
+const (
+	// LeadershipAcquired is emitted when the instance becomes the leader for a new term
+	LeadershipAcquired LeadershipEventType = "acquired"
+	// LeadershipRenewed is emitted when the leader extends the lease of its current term
+	LeadershipRenewed LeadershipEventType = "renewed"
+	// LeadershipLost is emitted when the leader steps down, is replaced or stops
+	LeadershipLost LeadershipEventType = "lost"
+)
+
+// LeadershipEvent describes a change of leadership of an instance. An acquired event may follow
+// another one without a lost event in between, if the instance took over again in a new term.
+type LeadershipEvent struct {
+	Type       LeadershipEventType
+	InstanceID string
+	Term       int64 // epoch of the leadership term, 0 if writes are not fenced
+}
+
+// observers holds the callbacks registered with OnLeadershipChange
+type observers struct {
+	mu        sync.Mutex
+	callbacks []func(LeadershipEvent)
+}
+
+// OnLeadershipChange registers a callback that is notified about every leadership event
+func (o *observers) OnLeadershipChange(fn func(LeadershipEvent)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.callbacks = append(o.callbacks, fn)
+}
+
+// notify calls the registered callbacks with the event
+func (o *observers) notify(event LeadershipEvent) {
+	o.mu.Lock()
+	callbacks := slices.Clone(o.callbacks)
+	o.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(event)
+	}
+}
+
+// leadership tracks whether this instance leads and until when its lease lasts. The lease
+// expires locally no later than the other instances consider it expired, so an instance
+// that cannot renew in time steps down before anyone else can take over.
+type leadership struct {
+	observers
 	instanceID string
-	isLeader   bool
-	stopCh     chan struct{}
 	mu         sync.Mutex
+	isLeader   bool
+	expiresAt  time.Time
+	epoch      int64
+	expiry     *time.Timer // steps down when the lease runs out without being renewed
+	changes    sync.Mutex  // keeps events in the order of the changes they describe
+}
+
+// IsLeader checks if the current instance is the leader and its lease has not expired
+func (s *leadership) IsLeader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isLeader && time.Now().Before(s.expiresAt)
+}
+
+// Epoch returns the epoch of the last leadership term of this instance
+func (s *leadership) Epoch() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.epoch
 }
 
-func NewDatabaseLeaderElection(db *pgxpool.Pool, instanceID string) *DatabaseLeaderElection {
-	return &DatabaseLeaderElection{
+// change applies a change of the leadership state and notifies the observers about the event it
+// returns, if any
+func (s *leadership) change(apply func() (LeadershipEventType, bool)) {
+	s.changes.Lock()
+	defer s.changes.Unlock()
+
+	s.mu.Lock()
+	eventType, ok := apply()
+	event := LeadershipEvent{Type: eventType, InstanceID: s.instanceID, Term: s.epoch}
+	s.mu.Unlock()
+
+	if ok {
+		s.notify(event)
+	}
+}
+
+// renewed records that this instance holds the lease of the given epoch until expiresAt
+func (s *leadership) renewed(expiresAt time.Time, epoch int64) {
+	s.change(func() (LeadershipEventType, bool) {
+		eventType := LeadershipRenewed
+		if !s.isLeader || s.epoch != epoch {
+			log.Printf("Instance %s became the leader for epoch %d", s.instanceID, epoch)
+			eventType = LeadershipAcquired
+		}
+		s.isLeader = true
+		s.expiresAt = expiresAt
+		s.epoch = epoch
+
+		if s.expiry == nil {
+			s.expiry = time.AfterFunc(time.Until(expiresAt), s.expire)
+		} else {
+			s.expiry.Reset(time.Until(expiresAt))
+		}
+		return eventType, true
+	})
+}
+
+// lost records that another instance leads or leadership could not be confirmed
+func (s *leadership) lost() {
+	s.change(func() (LeadershipEventType, bool) {
+		if !s.isLeader {
+			return "", false
+		}
+		log.Printf("Instance %s lost leadership", s.instanceID)
+		s.isLeader = false
+		return LeadershipLost, true
+	})
+}
+
+// expire steps down once the lease expired. It is called after a failed renewal, which keeps
+// leadership while the lease lasts, and when the lease runs out without being renewed.
+func (s *leadership) expire() {
+	s.change(func() (LeadershipEventType, bool) {
+		if !s.isLeader || time.Now().Before(s.expiresAt) {
+			return "", false
+		}
+		log.Printf("Instance %s stepped down: its lease expired before it could be renewed", s.instanceID)
+		s.isLeader = false
+		return LeadershipLost, true
+	})
+}
+
+// release gives up leadership without logging and reports whether this instance was the leader
+func (s *leadership) release() bool {
+	var wasLeader bool
+	s.change(func() (LeadershipEventType, bool) {
+		wasLeader = s.isLeader
+		s.isLeader = false
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+		return LeadershipLost, wasLeader
+	})
+	return wasLeader
+}
+
+// DatabaseLeaderElection elects the instance that holds a lease row in the leader election table.
+// The leader renews the lease with heartbeats; once a lease is older than its TTL, any instance may
+// take it over, which increments the epoch of the row.
+type DatabaseLeaderElection struct {
+	leadership
+	db        *pgxpool.Pool
+	table     string
+	leaderKey string
+	config    config.LeaderElectionConfig
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+// LeaderElectionOption configures a DatabaseLeaderElection
+type LeaderElectionOption func(*DatabaseLeaderElection)
+
+// WithLeaderElectionTables competes for the leader key in the leader election table named by the
+// given configuration instead of the default ones
+func WithLeaderElectionTables(tables config.TableConfig) LeaderElectionOption {
+	return func(l *DatabaseLeaderElection) {
+		l.table = tables.Table(tables.LeaderElection)
+		l.leaderKey = tables.LeaderKey
+	}
+}
+
+// WithLeaderElectionConfig sets the lease TTL and the renew and retry intervals
+func WithLeaderElectionConfig(cfg config.LeaderElectionConfig) LeaderElectionOption {
+	return func(l *DatabaseLeaderElection) {
+		l.config = cfg
+	}
+}
+
+func NewDatabaseLeaderElection(db *pgxpool.Pool, instanceID string, opts ...LeaderElectionOption) *DatabaseLeaderElection {
+	defaults := config.DefaultTableConfig()
+	l := &DatabaseLeaderElection{
+		leadership: leadership{instanceID: instanceID},
 		db:         db,
-		instanceID: instanceID,
-		isLeader:   false,
+		table:      defaults.Table(defaults.LeaderElection),
+		leaderKey:  defaults.LeaderKey,
+		config:     config.DefaultLeaderElectionConfig(),
 		stopCh:     make(chan struct{}),
 	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l
 }
 
 func (l *DatabaseLeaderElection) Start(ctx context.Context) error {
 	// Try to become the leader immediately
 	l.tryBecomeLeader(ctx)
 
-	// Start a goroutine to periodically try to become the leader
+	// Start a goroutine to periodically renew or try to take the lease
+	l.wg.Add(1)
 	go l.leaderElectionLoop(ctx)
 
 	return nil
 }
 
+// Stop waits for an attempt to renew or take the lease in flight, so that leadership cannot be
+// taken again after it was released. Stopping again does nothing.
 func (l *DatabaseLeaderElection) Stop() error {
-	close(l.stopCh)
+	l.stopOnce.Do(func() { close(l.stopCh) })
+	l.wg.Wait()
 
 	// If we are the leader, release leadership
-	l.mu.Lock()
-	isLeader := l.isLeader
-	l.isLeader = false
-	l.mu.Unlock()
-
-	if isLeader {
+	if l.release() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		// Release leadership
-		_, err := l.db.Exec(ctx, `
-			DELETE FROM leader_election
-			WHERE id = 'outbox_leader' AND instance_id = $1
-		`, l.instanceID)
+		// Expire the lease so another instance can take over at once. The row is kept, so that
+		// the epoch keeps increasing.
+		_, err := l.db.Exec(ctx, fmt.Sprintf(`
+			UPDATE %s
+			SET instance_id = '', last_heartbeat = '-infinity'
+			WHERE id = $1 AND instance_id = $2
+		`, l.table), l.leaderKey, l.instanceID)
 		if err != nil {
 			return fmt.Errorf("failed to release leadership: %w", err)
 		}
@@ -71,17 +266,13 @@ func (l *DatabaseLeaderElection) Stop() error {
 	return nil
 }
 
-// IsLeader checks if the current instance is the leader
-func (l *DatabaseLeaderElection) IsLeader() bool {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	return l.isLeader
-}
-
-// leaderElectionLoop regularly attempts to claim leadership
+// leaderElectionLoop renews the lease every RenewInterval while leading and tries to take it
+// every RetryInterval otherwise
 func (l *DatabaseLeaderElection) leaderElectionLoop(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	defer l.wg.Done()
+
+	timer := time.NewTimer(l.nextAttempt())
+	defer timer.Stop()
 
 	for {
 		select {
@@ -89,87 +280,80 @@ func (l *DatabaseLeaderElection) leaderElectionLoop(ctx context.Context) {
 			return
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-timer.C:
 			l.tryBecomeLeader(ctx)
+			timer.Reset(l.nextAttempt())
 		}
 	}
 }
 
-// tryBecomeLeader attempts to claim leadership
+func (l *DatabaseLeaderElection) nextAttempt() time.Duration {
+	if l.IsLeader() {
+		return l.config.RenewInterval
+	}
+	return l.config.RetryInterval
+}
+
+// tryBecomeLeader renews the lease if this instance holds it, or takes it over with the next epoch
+// if it expired, in a single statement so that two instances can never both succeed
 func (l *DatabaseLeaderElection) tryBecomeLeader(ctx context.Context) {
-	// First, check if there's a current leader and if it's still active
-	var instanceID string
-	var lastHeartbeat time.Time
-
-	err := l.db.QueryRow(ctx, `
-		SELECT instance_id, last_heartbeat
-		FROM leader_election
-		WHERE id = 'outbox_leader'
-	`).Scan(&instanceID, &lastHeartbeat)
-
-	// If there's no leader or the leader's heartbeat is too old, try to become the leader
-	if err != nil || time.Since(lastHeartbeat) > 10*time.Second {
-		// Try to insert or update the leader record
-		_, err := l.db.Exec(ctx, `
-			INSERT INTO leader_election (id, instance_id, last_heartbeat)
-			VALUES ('outbox_leader', $1, NOW())
-			ON CONFLICT (id) DO UPDATE
-			SET instance_id = $1, last_heartbeat = NOW()
-			WHERE leader_election.last_heartbeat < NOW() - INTERVAL '10 seconds'
-		`, l.instanceID)
+	// The local lease starts before the statement runs, so it never outlasts the one in the database
+	start := time.Now()
 
-		if err != nil {
-			log.Printf("Failed to update leader election: %v", err)
-			l.setIsLeader(false)
-			return
-		}
+	ctx, cancel := context.WithTimeout(ctx, l.config.LeaseTTL)
+	defer cancel()
 
-		// Check if we became the leader
-		err = l.db.QueryRow(ctx, `
-			SELECT instance_id
-			FROM leader_election
-			WHERE id = 'outbox_leader'
-		`).Scan(&instanceID)
+	var epoch int64
+	err := l.db.QueryRow(ctx, fmt.Sprintf(`
+		INSERT INTO %s AS le (id, instance_id, last_heartbeat, epoch)
+		VALUES ($1, $2, NOW(), 1)
+		ON CONFLICT (id) DO UPDATE
+		SET instance_id = $2, last_heartbeat = NOW(),
+			epoch = CASE WHEN le.instance_id = $2 THEN le.epoch ELSE le.epoch + 1 END
+		WHERE le.instance_id = $2 OR le.last_heartbeat < NOW() - $3::interval
+		RETURNING epoch
+	`, l.table), l.leaderKey, l.instanceID, l.config.LeaseTTL).Scan(&epoch)
 
-		if err != nil {
-			log.Printf("Failed to check leader: %v", err)
-			l.setIsLeader(false)
-			return
-		}
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		// Someone else holds a lease that has not expired
+		l.lost()
+	case err != nil:
+		log.Printf("Failed to renew leadership: %v", err)
+		l.expire()
+	default:
+		l.renewed(start.Add(l.config.LeaseTTL), epoch)
+	}
+}
 
-		l.setIsLeader(instanceID == l.instanceID)
-	} else if instanceID == l.instanceID {
-		// If we're already the leader, update the heartbeat
-		_, err := l.db.Exec(ctx, `
-			UPDATE leader_election
-			SET last_heartbeat = NOW()
-			WHERE id = 'outbox_leader' AND instance_id = $1
-		`, l.instanceID)
+// StandaloneLeaderElection always considers the current instance the leader.
+// It is used when every instance processes messages, e.g. in competing consumers mode.
+// It reports leadership as acquired on Start and lost on Stop.
+type StandaloneLeaderElection struct {
+	observers
+	instanceID string
+}
 
-		if err != nil {
-			log.Printf("Failed to update heartbeat: %v", err)
-			l.setIsLeader(false)
-			return
-		}
+func NewStandaloneLeaderElection(instanceID string) *StandaloneLeaderElection {
+	return &StandaloneLeaderElection{instanceID: instanceID}
+}
 
-		l.setIsLeader(true)
-	} else {
-		// Someone else is the leader
-		l.setIsLeader(false)
-	}
+func (l *StandaloneLeaderElection) Start(ctx context.Context) error {
+	l.notify(LeadershipEvent{Type: LeadershipAcquired, InstanceID: l.instanceID})
+	return nil
 }
 
-func (l *DatabaseLeaderElection) setIsLeader(isLeader bool) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+func (l *StandaloneLeaderElection) Stop() error {
+	l.notify(LeadershipEvent{Type: LeadershipLost, InstanceID: l.instanceID})
+	return nil
+}
 
-	if l.isLeader != isLeader {
-		if isLeader {
-			log.Printf("Instance %s became the leader", l.instanceID)
-		} else if l.isLeader {
-			log.Printf("Instance %s lost leadership", l.instanceID)
-		}
-	}
+// IsLeader always returns true
+func (l *StandaloneLeaderElection) IsLeader() bool {
+	return true
+}
 
-	l.isLeader = isLeader
+// Epoch always returns 0, as every instance may write
+func (l *StandaloneLeaderElection) Epoch() int64 {
+	return 0
 }
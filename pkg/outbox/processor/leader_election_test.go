@@ -2,12 +2,16 @@ package processor
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/migration"
 )
 
 func TestDatabaseLeaderElection(t *testing.T) {
@@ -21,6 +25,8 @@ func TestDatabaseLeaderElection(t *testing.T) {
 	}
 	defer dbPool.Close()
 
+	require.NoError(t, migration.Migrate(ctx, dbPool, config.DefaultTableConfig()))
+
 	// Clean up the leader_election table
 	_, err = dbPool.Exec(ctx, "DELETE FROM leader_election")
 	require.NoError(t, err)
@@ -47,9 +53,144 @@ func TestDatabaseLeaderElection(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, le.IsLeader(), "Should not be the leader after Stop")
 
-	// Verify the leader record was removed
+	// Verify the leader record was released
 	var count int
 	err = dbPool.QueryRow(ctx, "SELECT COUNT(*) FROM leader_election WHERE instance_id = $1", instanceID).Scan(&count)
 	assert.NoError(t, err)
-	assert.Equal(t, 0, count, "Leader record should be removed after Stop")
+	assert.Equal(t, 0, count, "Leader record should be released after Stop")
+}
+
+func TestDatabaseLeaderElectionLease(t *testing.T) {
+	ctx := context.Background()
+	dbPool := testDB(t)
+
+	_, err := dbPool.Exec(ctx, "DELETE FROM leader_election")
+	require.NoError(t, err)
+
+	cfg := config.DefaultLeaderElectionConfig()
+	cfg.LeaseTTL = 2 * time.Second
+	cfg.RenewInterval = 100 * time.Millisecond
+	cfg.RetryInterval = 100 * time.Millisecond
+
+	// Another instance holds a lease that has not expired yet
+	_, err = dbPool.Exec(ctx, "INSERT INTO leader_election (id, instance_id, last_heartbeat) VALUES ('outbox_leader', 'other-instance', NOW())")
+	require.NoError(t, err)
+
+	le := NewDatabaseLeaderElection(dbPool, "test-instance", WithLeaderElectionConfig(cfg))
+	require.NoError(t, le.Start(ctx))
+	assert.False(t, le.IsLeader(), "the lease of the other instance is still valid")
+
+	// The other instance stops renewing, so its lease expires after the TTL and is taken over
+	require.Eventually(t, le.IsLeader, 5*time.Second, 10*time.Millisecond)
+
+	var instanceID string
+	err = dbPool.QueryRow(ctx, "SELECT instance_id FROM leader_election WHERE id = 'outbox_leader'").Scan(&instanceID)
+	require.NoError(t, err)
+	assert.Equal(t, "test-instance", instanceID)
+	assert.Equal(t, int64(1), le.Epoch(), "taking over the lease of another instance starts a new epoch")
+
+	// The leader keeps renewing its lease well before it expires
+	time.Sleep(cfg.LeaseTTL + 500*time.Millisecond)
+	assert.True(t, le.IsLeader())
+	assert.Equal(t, int64(1), le.Epoch(), "renewals keep the epoch")
+
+	// Releasing keeps the row, so the next leader continues with a higher epoch
+	require.NoError(t, le.Stop())
+	require.NoError(t, le.Stop(), "stopping again does nothing")
+	time.Sleep(2 * cfg.RenewInterval)
+	assert.False(t, le.IsLeader(), "the stopped loop does not take the lease again")
+	next := NewDatabaseLeaderElection(dbPool, "next-instance", WithLeaderElectionConfig(cfg))
+	require.NoError(t, next.Start(ctx))
+	defer next.Stop()
+	require.True(t, next.IsLeader(), "a released lease can be taken over at once")
+	assert.Equal(t, int64(2), next.Epoch())
+}
+
+func TestLeadershipStepsDownWhenLeaseExpires(t *testing.T) {
+	l := leadership{instanceID: "test-instance"}
+	assert.False(t, l.IsLeader())
+
+	l.renewed(time.Now().Add(time.Hour), 1)
+	assert.True(t, l.IsLeader())
+	assert.Equal(t, int64(1), l.Epoch())
+
+	// A failed renewal keeps leadership while the lease lasts
+	l.expire()
+	assert.True(t, l.IsLeader())
+
+	// Once the lease expired the instance no longer leads, even before it learns about it
+	l.renewed(time.Now().Add(-time.Millisecond), 1)
+	assert.False(t, l.IsLeader())
+
+	// The instance steps down by itself when the lease runs out
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return !l.isLeader
+	}, time.Second, time.Millisecond, "stepping down clears leadership")
+
+	l.renewed(time.Now().Add(time.Hour), 2)
+	assert.Equal(t, int64(2), l.Epoch(), "taking over again starts a new epoch")
+	l.lost()
+	assert.False(t, l.IsLeader())
+
+	l.renewed(time.Now().Add(time.Hour), 1)
+	assert.True(t, l.release())
+	assert.False(t, l.release())
+}
+
+func TestLeadershipEvents(t *testing.T) {
+	l := leadership{instanceID: "test-instance"}
+
+	var mu sync.Mutex
+	var events []LeadershipEvent
+	l.OnLeadershipChange(func(event LeadershipEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+	recorded := func() []LeadershipEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]LeadershipEvent(nil), events...)
+	}
+
+	l.renewed(time.Now().Add(time.Hour), 1)
+	l.renewed(time.Now().Add(time.Hour), 1)
+	l.renewed(time.Now().Add(time.Hour), 2)
+	l.lost()
+	l.lost()
+	assert.Equal(t, []LeadershipEvent{
+		{Type: LeadershipAcquired, InstanceID: "test-instance", Term: 1},
+		{Type: LeadershipRenewed, InstanceID: "test-instance", Term: 1},
+		{Type: LeadershipAcquired, InstanceID: "test-instance", Term: 2},
+		{Type: LeadershipLost, InstanceID: "test-instance", Term: 2},
+	}, recorded(), "losing leadership again is not reported")
+
+	// A lease that runs out is reported as lost without waiting for the next renewal
+	l.renewed(time.Now().Add(20*time.Millisecond), 3)
+	require.Eventually(t, func() bool { return len(recorded()) == 6 }, time.Second, time.Millisecond)
+	assert.Equal(t, LeadershipEvent{Type: LeadershipLost, InstanceID: "test-instance", Term: 3}, recorded()[5])
+
+	l.renewed(time.Now().Add(time.Hour), 4)
+	assert.True(t, l.release())
+	assert.False(t, l.release())
+	assert.Equal(t, LeadershipEvent{Type: LeadershipLost, InstanceID: "test-instance", Term: 4}, recorded()[7])
+	assert.Len(t, recorded(), 8)
+}
+
+func TestStandaloneLeadershipEvents(t *testing.T) {
+	l := NewStandaloneLeaderElection("test-instance")
+
+	var events []LeadershipEvent
+	l.OnLeadershipChange(func(event LeadershipEvent) {
+		events = append(events, event)
+	})
+
+	require.NoError(t, l.Start(context.Background()))
+	require.NoError(t, l.Stop())
+	assert.Equal(t, []LeadershipEvent{
+		{Type: LeadershipAcquired, InstanceID: "test-instance"},
+		{Type: LeadershipLost, InstanceID: "test-instance"},
+	}, events)
 }
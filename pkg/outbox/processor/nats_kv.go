@@ -0,0 +1,247 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+)
+
+// NatsKVLeaderElection elects the instance holding the leader key of a NATS JetStream key-value
+// bucket. Only taking the key writes to PostgreSQL, to start a new epoch in the leader row.
+type NatsKVLeaderElection struct {
+	leadership
+	conn      *nats.Conn
+	kv        nats.KeyValue
+	key       string
+	db        *pgxpool.Pool
+	table     string
+	leaderKey string
+	config    config.LeaderElectionConfig
+	revision  uint64 // revision of the last write of the key by this instance, 0 if it does not hold it
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewNatsKVLeaderElection connects to NATS to compete for the leader key named by tables.
+// db may be nil to not fence writes.
+func NewNatsKVLeaderElection(
+	natsURL string,
+	db *pgxpool.Pool,
+	instanceID string,
+	tables config.TableConfig,
+	cfg config.LeaderElectionConfig,
+) (*NatsKVLeaderElection, error) {
+	conn, err := nats.Connect(natsURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	key := tables.LeaderElection + "." + tables.LeaderKey
+	if tables.Schema != "" {
+		key = tables.Schema + "." + key
+	}
+
+	return &NatsKVLeaderElection{
+		leadership: leadership{instanceID: instanceID},
+		conn:       conn,
+		key:        key,
+		db:         db,
+		table:      tables.Table(tables.LeaderElection),
+		leaderKey:  tables.LeaderKey,
+		config:     cfg,
+	}, nil
+}
+
+// Start binds the bucket, creating it with the lease TTL if it does not exist, and starts competing
+// for the leader key
+func (l *NatsKVLeaderElection) Start(ctx context.Context) error {
+	kv, err := l.bucket()
+	if err != nil {
+		return err
+	}
+	l.kv = kv
+
+	ctx, cancel := context.WithCancel(ctx)
+	l.cancel = cancel
+
+	// Try to become the leader immediately
+	l.tryBecomeLeader(ctx)
+
+	l.wg.Add(1)
+	go l.leaderElectionLoop(ctx)
+
+	return nil
+}
+
+// Stop deletes the leader key if this instance holds it, so another instance can take over at once
+func (l *NatsKVLeaderElection) Stop() error {
+	if l.cancel != nil {
+		l.cancel()
+	}
+	l.wg.Wait()
+	defer l.conn.Close()
+
+	if l.release() && l.revision != 0 {
+		if err := l.kv.Delete(l.key, nats.LastRevision(l.revision)); err != nil {
+			return fmt.Errorf("failed to release leadership: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// bucket returns the key-value bucket holding the leader key
+func (l *NatsKVLeaderElection) bucket() (nats.KeyValue, error) {
+	js, err := l.conn.JetStream(nats.MaxWait(l.config.LeaseTTL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	kv, err := js.KeyValue(l.config.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      l.config.Bucket,
+			Description: "Outbox leader election",
+			History:     1,
+			TTL:         l.config.LeaseTTL,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind leader election bucket %s: %w", l.config.Bucket, err)
+	}
+
+	status, err := kv.Status()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status of leader election bucket %s: %w", l.config.Bucket, err)
+	}
+
+	// A key expiring before the lease would let two instances lead, one outliving it delays failover
+	if ttl := status.TTL(); ttl != l.config.LeaseTTL {
+		return nil, fmt.Errorf("leader election bucket %s must expire keys after the lease TTL %s, but has TTL %s",
+			l.config.Bucket, l.config.LeaseTTL, ttl)
+	}
+
+	return kv, nil
+}
+
+// leaderElectionLoop renews the lease every RenewInterval while leading and tries to take it
+// every RetryInterval otherwise
+func (l *NatsKVLeaderElection) leaderElectionLoop(ctx context.Context) {
+	defer l.wg.Done()
+
+	timer := time.NewTimer(l.nextAttempt())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			l.tryBecomeLeader(ctx)
+			timer.Reset(l.nextAttempt())
+		}
+	}
+}
+
+func (l *NatsKVLeaderElection) nextAttempt() time.Duration {
+	if l.IsLeader() {
+		return l.config.RenewInterval
+	}
+	return l.config.RetryInterval
+}
+
+// tryBecomeLeader renews the key if this instance holds it, or creates it if it does not exist.
+// Both only succeed if nobody else wrote the key since the revision this instance last saw.
+func (l *NatsKVLeaderElection) tryBecomeLeader(ctx context.Context) {
+	// The local lease starts before the write, so it never outlasts the key in the bucket
+	start := time.Now()
+
+	if l.revision != 0 {
+		revision, err := l.kv.Update(l.key, []byte(l.instanceID), l.revision)
+		switch {
+		case errors.Is(err, nats.ErrKeyExists):
+			// Another instance took over the key after it expired
+			l.revision = 0
+			l.lost()
+		case err != nil:
+			log.Printf("Failed to renew leadership: %v", err)
+			l.expire()
+		default:
+			l.revision = revision
+			l.renewed(start.Add(l.config.LeaseTTL), l.Epoch())
+		}
+		return
+	}
+
+	revision, err := l.take()
+	if err != nil {
+		if !errors.Is(err, nats.ErrKeyExists) {
+			log.Printf("Failed to take leadership: %v", err)
+		}
+		l.lost()
+		return
+	}
+
+	epoch, err := l.startEpoch(ctx, revision, start.Add(l.config.LeaseTTL))
+	if err != nil {
+		log.Printf("Failed to take leadership: %v", err)
+
+		// Leave the key to the other instances rather than leading without a valid epoch
+		if err := l.kv.Delete(l.key, nats.LastRevision(revision)); err != nil {
+			log.Printf("Failed to release the leader key: %v", err)
+		}
+		l.lost()
+		return
+	}
+
+	l.revision = revision
+	l.renewed(start.Add(l.config.LeaseTTL), epoch)
+}
+
+// take creates the leader key, or takes it over if it is left from a previous run of this instance
+func (l *NatsKVLeaderElection) take() (uint64, error) {
+	revision, err := l.kv.Create(l.key, []byte(l.instanceID))
+	if !errors.Is(err, nats.ErrKeyExists) {
+		return revision, err
+	}
+
+	entry, getErr := l.kv.Get(l.key)
+	if getErr != nil || string(entry.Value()) != l.instanceID {
+		return 0, err
+	}
+
+	return l.kv.Update(l.key, []byte(l.instanceID), entry.Revision())
+}
+
+// startEpoch starts a new epoch in the leader row, past both its epoch and the revision of the key,
+// unless the key may have expired at deadline
+func (l *NatsKVLeaderElection) startEpoch(ctx context.Context, revision uint64, deadline time.Time) (int64, error) {
+	if l.db == nil {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var epoch int64
+	err := l.db.QueryRow(ctx, fmt.Sprintf(`
+		INSERT INTO %s AS le (id, instance_id, last_heartbeat, epoch)
+		VALUES ($1, $2, NOW(), $3 + 1)
+		ON CONFLICT (id) DO UPDATE
+		SET instance_id = $2, last_heartbeat = NOW(), epoch = GREATEST(le.epoch, $3) + 1
+		RETURNING epoch
+	`, l.table), l.leaderKey, l.instanceID, int64(revision)).Scan(&epoch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a leadership epoch: %w", err)
+	}
+
+	return epoch, nil
+}
@@ -0,0 +1,191 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+)
+
+// runNatsServer starts an embedded NATS server with JetStream for the duration of the test
+func runNatsServer(t *testing.T) string {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(t, err)
+
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+
+	return s.ClientURL()
+}
+
+func newNatsKVLeaderElection(t *testing.T, natsURL, instanceID string) *NatsKVLeaderElection {
+	t.Helper()
+
+	cfg := config.DefaultLeaderElectionConfig()
+	cfg.LeaseTTL = time.Second
+	cfg.RenewInterval = 100 * time.Millisecond
+	cfg.RetryInterval = 50 * time.Millisecond
+
+	le, err := NewNatsKVLeaderElection(natsURL, nil, instanceID, config.DefaultTableConfig(), cfg)
+	require.NoError(t, err)
+	return le
+}
+
+func TestNatsKVLeaderElection(t *testing.T) {
+	natsURL := runNatsServer(t)
+	ctx := context.Background()
+
+	first := newNatsKVLeaderElection(t, natsURL, "first-instance")
+	second := newNatsKVLeaderElection(t, natsURL, "second-instance")
+
+	require.NoError(t, first.Start(ctx))
+	assert.True(t, first.IsLeader(), "the first instance takes the free key at once")
+	assert.Zero(t, first.Epoch(), "writes are not fenced without a database")
+
+	require.NoError(t, second.Start(ctx))
+	defer second.Stop()
+	assert.False(t, second.IsLeader())
+
+	// Renewals keep the key well beyond its TTL
+	time.Sleep(1500 * time.Millisecond)
+	assert.True(t, first.IsLeader())
+	assert.False(t, second.IsLeader())
+
+	// Stopping the leader deletes the key, so the other instance takes over without waiting for it to expire
+	require.NoError(t, first.Stop())
+	assert.False(t, first.IsLeader())
+	require.Eventually(t, second.IsLeader, 500*time.Millisecond, 10*time.Millisecond)
+
+	// An instance that restarts while its key has not expired takes it back
+	require.NoError(t, second.Stop())
+	second = newNatsKVLeaderElection(t, natsURL, "second-instance")
+	require.NoError(t, second.Start(ctx))
+	assert.True(t, second.IsLeader())
+}
+
+func TestNatsKVLeaderElectionFailover(t *testing.T) {
+	natsURL := runNatsServer(t)
+	ctx := context.Background()
+
+	leader := newNatsKVLeaderElection(t, natsURL, "leader-instance")
+	require.NoError(t, leader.Start(ctx))
+	defer leader.Stop()
+	require.True(t, leader.IsLeader())
+
+	events := make(chan LeadershipEvent, 10)
+	leader.OnLeadershipChange(func(event LeadershipEvent) {
+		select {
+		case events <- event:
+		default:
+		}
+	})
+
+	// Another writer of the key makes the leader's compare-and-set fail, so it steps down
+	conn, err := nats.Connect(natsURL)
+	require.NoError(t, err)
+	defer conn.Close()
+	js, err := conn.JetStream()
+	require.NoError(t, err)
+	kv, err := js.KeyValue(config.DefaultLeaderElectionBucket)
+	require.NoError(t, err)
+	_, err = kv.Put(leader.key, []byte("intruder"))
+	require.NoError(t, err)
+
+	for event := range events {
+		if event.Type == LeadershipLost {
+			assert.Equal(t, LeadershipEvent{Type: LeadershipLost, InstanceID: "leader-instance"}, event)
+			break
+		}
+	}
+	assert.False(t, leader.IsLeader())
+
+	// Once the key expires, because nobody renews it, an instance takes over
+	start := time.Now()
+	require.Eventually(t, leader.IsLeader, 3*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond, "the key lasts for its TTL")
+}
+
+func TestNatsKVLeaderElectionRejectsBucketTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, 100 * time.Millisecond, time.Minute} {
+		natsURL := runNatsServer(t)
+
+		conn, err := nats.Connect(natsURL)
+		require.NoError(t, err)
+		defer conn.Close()
+		js, err := conn.JetStream()
+		require.NoError(t, err)
+		_, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: config.DefaultLeaderElectionBucket, TTL: ttl})
+		require.NoError(t, err)
+
+		// The lease TTL of newNatsKVLeaderElection is a second
+		le := newNatsKVLeaderElection(t, natsURL, "test-instance")
+		err = le.Start(context.Background())
+		assert.ErrorContains(t, err, "lease TTL", "bucket TTL %s", ttl)
+		assert.NoError(t, le.Stop())
+	}
+}
+
+func TestNatsKVLeaderElectionFencing(t *testing.T) {
+	ctx := context.Background()
+	dbPool := testDB(t)
+
+	tables := config.DefaultTableConfig()
+	tables.LeaderKey = "nats_kv_test"
+	_, err := dbPool.Exec(ctx, "DELETE FROM leader_election WHERE id = $1", tables.LeaderKey)
+	require.NoError(t, err)
+
+	natsURL := runNatsServer(t)
+	cfg := config.DefaultLeaderElectionConfig()
+	cfg.LeaseTTL = time.Second
+	cfg.RenewInterval = 100 * time.Millisecond
+	cfg.RetryInterval = 50 * time.Millisecond
+
+	epoch := func() int64 {
+		var epoch int64
+		require.NoError(t, dbPool.QueryRow(ctx, "SELECT epoch FROM leader_election WHERE id = $1", tables.LeaderKey).Scan(&epoch))
+		return epoch
+	}
+
+	first, err := NewNatsKVLeaderElection(natsURL, dbPool, "first-instance", tables, cfg)
+	require.NoError(t, err)
+	require.NoError(t, first.Start(ctx))
+	require.True(t, first.IsLeader())
+	assert.Positive(t, first.Epoch())
+	assert.Equal(t, first.Epoch(), epoch(), "taking the key starts an epoch in the leader row")
+
+	// Renewals do not touch the database
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, first.Epoch(), epoch())
+
+	// An epoch from another backend, or from before the bucket was recreated, may exceed the revisions
+	firstEpoch := first.Epoch() + 1000
+	require.NoError(t, first.Stop())
+	_, err = dbPool.Exec(ctx, "UPDATE leader_election SET epoch = $2 WHERE id = $1", tables.LeaderKey, firstEpoch)
+	require.NoError(t, err)
+
+	second, err := NewNatsKVLeaderElection(natsURL, dbPool, "second-instance", tables, cfg)
+	require.NoError(t, err)
+	require.NoError(t, second.Start(ctx))
+	defer second.Stop()
+	require.True(t, second.IsLeader())
+	assert.Greater(t, second.Epoch(), firstEpoch, "a new leader starts a new epoch")
+	assert.Equal(t, second.Epoch(), epoch())
+}
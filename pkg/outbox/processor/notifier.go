@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Notifier wakes the processor up as soon as new messages are available
+type Notifier interface {
+	Start(ctx context.Context) error
+	Stop() error
+	// Notifications receives a value whenever new messages may be available
+	Notifications() <-chan struct{}
+}
+
+// PostgresNotifier LISTENs on a PostgreSQL channel that is notified when messages are enqueued.
+// It holds a dedicated connection outside of the pool for as long as it runs.
+type PostgresNotifier struct {
+	db       *pgxpool.Pool
+	channel  string
+	notifyCh chan struct{}
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewPostgresNotifier(db *pgxpool.Pool, channel string) *PostgresNotifier {
+	return &PostgresNotifier{
+		db:       db,
+		channel:  channel,
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+func (n *PostgresNotifier) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	n.cancel = cancel
+
+	n.wg.Add(1)
+	go n.listenLoop(ctx)
+
+	return nil
+}
+
+func (n *PostgresNotifier) Stop() error {
+	if n.cancel != nil {
+		n.cancel()
+	}
+	n.wg.Wait()
+
+	return nil
+}
+
+// Notifications receives a value whenever new messages may be available
+func (n *PostgresNotifier) Notifications() <-chan struct{} {
+	return n.notifyCh
+}
+
+// listenLoop keeps a listening connection open, reconnecting after failures
+func (n *PostgresNotifier) listenLoop(ctx context.Context) {
+	defer n.wg.Done()
+
+	for {
+		err := n.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Listening for outbox notifications failed, reconnecting: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// listen opens a dedicated connection and forwards notifications until an error occurs
+func (n *PostgresNotifier) listen(ctx context.Context) error {
+	conn, err := pgx.ConnectConfig(ctx, n.db.Config().ConnConfig)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{n.channel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", n.channel, err)
+	}
+
+	// Messages may have been enqueued while we were not listening
+	n.notify()
+
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		n.notify()
+	}
+}
+
+// notify signals a pending notification without blocking; notifications that
+// arrive while one is already pending are coalesced
+func (n *PostgresNotifier) notify() {
+	select {
+	case n.notifyCh <- struct{}{}:
+	default:
+	}
+}
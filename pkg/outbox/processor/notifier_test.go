@@ -0,0 +1,57 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/repository"
+)
+
+func TestPostgresNotifier(t *testing.T) {
+	ctx := context.Background()
+	dbPool := testDB(t)
+
+	channel := "outbox_notifier_test"
+	repo := repository.NewPostgresRepository(dbPool, repository.WithNotifyChannel(channel))
+
+	notifier := NewPostgresNotifier(dbPool, channel)
+	require.NoError(t, notifier.Start(ctx))
+	defer notifier.Stop()
+
+	// The notifier signals once it is listening, to catch up on messages enqueued before
+	select {
+	case <-notifier.Notifications():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the initial notification")
+	}
+
+	message, err := model.NewOutboxMessage("test.topic", map[string]interface{}{
+		"key": "value",
+	})
+	require.NoError(t, err)
+
+	tx, err := dbPool.Begin(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback(ctx)
+
+	require.NoError(t, repo.EnqueueMessage(ctx, tx, message))
+
+	// Nothing is delivered before the transaction commits
+	select {
+	case <-notifier.Notifications():
+		t.Fatal("Received a notification before commit")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	require.NoError(t, tx.Commit(ctx))
+
+	select {
+	case <-notifier.Notifications():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the enqueue notification")
+	}
+}
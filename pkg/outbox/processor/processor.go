@@ -2,44 +2,99 @@ package processor
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/metrics"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/publisher"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/repository"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/tracing"
 )
 
 type Processor struct {
 	repo           repository.Repository
 	publisher      publisher.Publisher
 	leaderElection LeaderElection
+	notifier       Notifier
+	metrics        metrics.Metrics
+	tracerProvider trace.TracerProvider
+	instanceID     string
 	config         config.ProcessorConfig
+	workers        *workerPool
+	leadershipCh   chan struct{} // signals a change of leadership to the processing loop
 	stopCh         chan struct{}
 	wg             sync.WaitGroup
 	mu             sync.Mutex
 	running        bool
+	stopped        bool // the workers and the leader election are shut down for good
+}
+
+// Option configures optional collaborators of a Processor
+type Option func(*Processor)
+
+// WithNotifier makes the processor handle a batch as soon as the notifier signals new
+// messages, in addition to polling every PollingInterval
+func WithNotifier(notifier Notifier) Option {
+	return func(p *Processor) {
+		p.notifier = notifier
+	}
+}
+
+// WithMetrics makes the processor report publishing activity, leadership and backlog
+func WithMetrics(m metrics.Metrics) Option {
+	return func(p *Processor) {
+		p.metrics = m
+	}
+}
+
+// WithTracerProvider sets the provider of publish spans, the global provider is used by default
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(p *Processor) {
+		p.tracerProvider = tp
+	}
 }
 
 func NewProcessor(
 	repo repository.Repository,
 	publisher publisher.Publisher,
 	leaderElection LeaderElection,
+	instanceID string,
 	config config.ProcessorConfig,
+	opts ...Option,
 ) *Processor {
-	return &Processor{
+	p := &Processor{
 		repo:           repo,
 		publisher:      publisher,
 		leaderElection: leaderElection,
+		instanceID:     instanceID,
 		config:         config,
+		metrics:        metrics.NoopMetrics{},
+		workers:        newWorkerPool(config.Workers, maxInFlight(config.Workers, config.BatchSize, config.MaxInFlight)),
+		leadershipCh:   make(chan struct{}, 1),
 		stopCh:         make(chan struct{}),
 	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	leaderElection.OnLeadershipChange(p.leadershipChanged)
+
+	return p
 }
 
-// Start begins the processing loop
+// Start begins the processing loop. A processor cannot be started again once it was stopped.
 func (p *Processor) Start(ctx context.Context) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -47,20 +102,43 @@ func (p *Processor) Start(ctx context.Context) error {
 	if p.running {
 		return nil
 	}
+	if p.stopped {
+		return errors.New("processor was stopped and cannot be restarted")
+	}
 
 	// Start the leader election
 	if err := p.leaderElection.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start leader election: %w", err)
 	}
 
+	if p.notifier != nil {
+		if err := p.notifier.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start notifier: %w", err)
+		}
+	}
+
 	p.running = true
-	p.wg.Add(1)
+	p.startWorkers(ctx)
+	p.wg.Add(2)
 
 	go p.processLoop(ctx)
+	go p.recoveryLoop(ctx)
+
+	if _, noop := p.metrics.(metrics.NoopMetrics); !noop {
+		p.wg.Add(1)
+		go p.metricsLoop(ctx)
+	}
+
+	if p.config.CompletedRetention > 0 || p.config.DeadLetterRetention > 0 || p.config.IdempotencyKeyRetention > 0 {
+		p.wg.Add(1)
+		go p.cleanupLoop(ctx)
+	}
 
 	return nil
 }
 
+// Stop stops claiming messages and waits until the workers have published the messages
+// already claimed, before giving up leadership
 func (p *Processor) Stop() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -71,7 +149,15 @@ func (p *Processor) Stop() error {
 
 	close(p.stopCh)
 	p.wg.Wait()
+	p.stopWorkers()
 	p.running = false
+	p.stopped = true
+
+	if p.notifier != nil {
+		if err := p.notifier.Stop(); err != nil {
+			return fmt.Errorf("failed to stop notifier: %w", err)
+		}
+	}
 
 	if err := p.leaderElection.Stop(); err != nil {
 		return fmt.Errorf("failed to stop leader election: %w", err)
@@ -80,13 +166,101 @@ func (p *Processor) Stop() error {
 	return nil
 }
 
-// processLoop polls for and processes outbox messages
+// leadershipChanged reports leadership and wakes up the processing loop to start or stop processing
+func (p *Processor) leadershipChanged(event LeadershipEvent) {
+	p.metrics.SetLeader(event.Type != LeadershipLost)
+
+	select {
+	case p.leadershipCh <- struct{}{}:
+	default:
+	}
+}
+
+// processLoop waits until this instance becomes the leader and processes messages while it leads
 func (p *Processor) processLoop(ctx context.Context) {
 	defer p.wg.Done()
 
+	for {
+		if !p.leaderElection.IsLeader() {
+			select {
+			case <-p.stopCh:
+				return
+			case <-ctx.Done():
+				return
+			case <-p.leadershipCh:
+				continue
+			}
+		}
+
+		if !p.lead(ctx) {
+			return
+		}
+	}
+}
+
+// lead polls for and processes outbox messages until this instance loses leadership. It returns
+// false if the processor is stopping.
+func (p *Processor) lead(ctx context.Context) bool {
 	ticker := time.NewTicker(p.config.PollingInterval)
 	defer ticker.Stop()
 
+	// A nil channel never fires, so without a notifier the loop only polls
+	var notifications <-chan struct{}
+	if p.notifier != nil {
+		notifications = p.notifier.Notifications()
+	}
+
+	p.processPending(ctx)
+
+	for {
+		select {
+		case <-p.stopCh:
+			return false
+		case <-ctx.Done():
+			return false
+		case <-p.leadershipCh:
+			if !p.leaderElection.IsLeader() {
+				return true
+			}
+		case <-ticker.C:
+			p.processPending(ctx)
+		case <-notifications:
+			p.processPending(ctx)
+		}
+	}
+}
+
+// processPending claims batches while this instance is the leader and full batches
+// indicate that more messages are waiting
+func (p *Processor) processPending(ctx context.Context) {
+	for p.leaderElection.IsLeader() {
+		full, err := p.processBatch(ctx)
+		if err != nil {
+			log.Printf("Error processing batch: %v", err)
+			return
+		}
+		if !full {
+			return
+		}
+
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// recoveryLoop periodically returns messages whose processing lock expired to pending,
+// so messages claimed by a crashed instance are picked up by the current leader
+func (p *Processor) recoveryLoop(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.RecoveryInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-p.stopCh:
@@ -95,70 +269,259 @@ func (p *Processor) processLoop(ctx context.Context) {
 			return
 		case <-ticker.C:
 			if p.leaderElection.IsLeader() {
-				if err := p.processBatch(ctx); err != nil {
-					log.Printf("Error processing batch: %v", err)
+				released, err := p.repo.ReleaseExpiredLocks(fenced(ctx, p.leaderElection.Epoch()))
+				if err != nil {
+					log.Printf("Error releasing expired locks: %v", err)
+				} else if released > 0 {
+					log.Printf("Returned %d messages with expired locks to pending", released)
 				}
 			}
 		}
 	}
 }
 
-// processBatch handles a group of outbox messages
-func (p *Processor) processBatch(ctx context.Context) error {
-	// Get pending messages
-	messages, err := p.repo.GetPendingMessages(ctx, p.config.BatchSize)
+// metricsLoop periodically reports the size and age of the backlog
+func (p *Processor) metricsLoop(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.MetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !p.leaderElection.IsLeader() {
+				continue
+			}
+
+			stats, err := p.repo.GetBacklogStats(ctx)
+			if err != nil {
+				log.Printf("Error collecting backlog metrics: %v", err)
+				continue
+			}
+
+			var oldestAge time.Duration
+			if stats.OldestCreatedAt != nil {
+				oldestAge = time.Since(*stats.OldestCreatedAt)
+			}
+			p.metrics.SetBacklog(stats.Pending, oldestAge)
+		}
+	}
+}
+
+// processBatch claims as many messages as the in-flight bound allows, up to a batch, in a single
+// statement and hands them to the workers. It reports whether the claim was full, in which case
+// more messages may be waiting. The claim and the outcome of every claimed message are fenced by
+// the current leadership epoch, so they are rejected once another instance became the leader.
+func (p *Processor) processBatch(ctx context.Context) (bool, error) {
+	slots := p.workers.acquire(ctx, p.stopCh, p.config.BatchSize)
+	if slots == 0 {
+		return false, nil
+	}
+
+	start := time.Now()
+	epoch := p.leaderElection.Epoch()
+	messages, err := p.repo.ClaimPendingMessages(fenced(ctx, epoch), slots, p.instanceID, p.config.LockTimeout)
 	if err != nil {
-		log.Printf("Failed to get pending messages: %v", err)
-		return fmt.Errorf("failed to get pending messages: %w", err)
+		p.workers.release(slots)
+		log.Printf("Failed to claim pending messages: %v", err)
+		return false, fmt.Errorf("failed to claim pending messages: %w", err)
 	}
+	p.workers.release(slots - len(messages))
 
 	if len(messages) > 0 {
 		log.Printf("Processing %d pending messages", len(messages))
+		p.workers.dispatch(messages, epoch, start)
 	}
 
-	// Process each message
+	return len(messages) == slots, nil
+}
+
+// publishBatch publishes messages this instance has claimed and records the outcome: published
+// messages are completed and failed ones rescheduled with one statement each, while messages
+// that exhausted their retries are dead-lettered individually
+func (p *Processor) publishBatch(ctx context.Context, messages []*model.OutboxMessage) error {
+	var errs []error
+
+	now := time.Now()
+	pending := make([]*model.OutboxMessage, 0, len(messages))
 	for _, msg := range messages {
-		if err := p.processMessage(ctx, msg); err != nil {
-			log.Printf("Error processing message %s: %v", msg.ID, err)
+		if msg.Expired(now) {
+			if err := p.expireMessage(ctx, msg); err != nil {
+				errs = append(errs, err)
+			}
+			continue
 		}
+		pending = append(pending, msg)
 	}
 
-	return nil
-}
+	if len(pending) == 0 {
+		return errors.Join(errs...)
+	}
 
-// processMessage handles a single outbox message
-func (p *Processor) processMessage(ctx context.Context, msg *model.OutboxMessage) error {
-	// Mark the message as processing
-	if err := p.repo.MarkMessageAsProcessing(ctx, msg.ID); err != nil {
-		log.Printf("Failed to mark message %s as processing: %v", msg.ID, err)
-		return fmt.Errorf("failed to mark message as processing: %w", err)
+	spans := make([]trace.Span, len(pending))
+	batch := make([]publisher.Message, len(pending))
+	for i, msg := range pending {
+		_, spans[i] = tracing.StartPublishSpan(ctx, p.tracerProvider, msg)
+		batch[i] = publisher.Message{
+			Topic:   msg.Topic,
+			Payload: msg.Payload,
+			Headers: publishHeaders(msg.Headers, msg.ID, msg.SequenceNumber),
+		}
 	}
 
-	// Publish the message
-	err := p.publisher.Publish(ctx, msg.Topic, msg.Payload)
+	publishErrs := p.publishAll(ctx, pending, batch)
+
+	var completed []uuid.UUID
+	var retries []repository.Retry
+	for i, msg := range pending {
+		span := spans[i]
+		err := publishErrs[i]
+		if err == nil {
+			span.End()
+			p.metrics.MessagePublished(msg.Topic, time.Since(msg.CreatedAt))
+			completed = append(completed, msg.ID)
+			continue
+		}
 
-	if err != nil {
 		log.Printf("Failed to publish message %s: %v", msg.ID, err)
-		// If publishing failed, mark the message as failed
-		markErr := p.repo.MarkMessageAsFailed(ctx, msg.ID, err)
-		if markErr != nil {
-			log.Printf("Failed to mark message %s as failed: %v", msg.ID, markErr)
-			return fmt.Errorf("failed to mark message as failed: %w", markErr)
+		p.metrics.MessageFailed(msg.Topic)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to publish message")
+		span.End()
+
+		// Schedule another attempt while retries remain, otherwise the message is terminally failed
+		if msg.RetryCount < p.config.MaxRetries {
+			retries = append(retries, repository.Retry{
+				ID:    msg.ID,
+				Err:   err,
+				Delay: retryDelay(msg.RetryCount+1, p.config.RetryBaseDelay, p.config.RetryMaxDelay),
+			})
+			continue
 		}
 
-		// If we've exceeded the maximum number of retries, log an error
-		if msg.RetryCount >= p.config.MaxRetries {
-			log.Printf("Message %s exceeded maximum retries: %v", msg.ID, err)
+		log.Printf("Message %s exceeded maximum retries: %v", msg.ID, err)
+		if err := p.deadLetter(ctx, msg, err); err != nil {
+			errs = append(errs, err)
 		}
+	}
+
+	if err := p.repo.MarkMessagesAsCompleted(ctx, completed, p.instanceID); err != nil {
+		logOutcomeError(err, "mark %d messages as completed", len(completed))
+		errs = append(errs, fmt.Errorf("failed to mark messages as completed: %w", err))
+	}
+
+	if err := p.repo.ScheduleRetries(ctx, retries, p.instanceID); err != nil {
+		logOutcomeError(err, "schedule retries for %d messages", len(retries))
+		errs = append(errs, fmt.Errorf("failed to schedule message retries: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// logOutcomeError logs a failed outcome write. Messages whose lock expired while they were
+// published were left unchanged, so whichever instance claims them next publishes them again.
+func logOutcomeError(err error, format string, args ...any) {
+	action := fmt.Sprintf(format, args...)
+	if errors.Is(err, repository.ErrLockLost) {
+		log.Printf("Lock lost, did not %s: %v", action, err)
+		return
+	}
+	log.Printf("Failed to %s: %v", action, err)
+}
+
+// publishAll publishes a batch and returns the error of every message at the same index. Batch
+// publishers pipeline the whole batch; otherwise messages are published concurrently, which is safe
+// because a batch holds at most one message per partition key.
+func (p *Processor) publishAll(ctx context.Context, messages []*model.OutboxMessage, batch []publisher.Message) []error {
+	if bp, ok := p.publisher.(publisher.BatchPublisher); ok {
+		return bp.PublishBatch(ctx, batch)
+	}
+
+	errs := make([]error, len(batch))
+	publish := func(i int) {
+		errs[i] = p.publisher.Publish(ctx, batch[i].Topic, batch[i].Payload, batch[i].Headers)
+	}
+
+	var wg sync.WaitGroup
+	for i := range messages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			publish(i)
+		}(i)
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// expireMessage discards a message that is no longer worth publishing
+func (p *Processor) expireMessage(ctx context.Context, msg *model.OutboxMessage) error {
+	reason := fmt.Sprintf("message expired at %s before it could be published", msg.ExpiresAt.Format(time.RFC3339))
+	if err := p.repo.MarkMessageAsExpired(ctx, msg.ID, p.instanceID, reason); err != nil {
+		logOutcomeError(err, "mark message %s as expired", msg.ID)
+		return fmt.Errorf("failed to mark message as expired: %w", err)
+	}
+
+	log.Printf("Discarded message %s: %s", msg.ID, reason)
+	p.metrics.MessageExpired(msg.Topic)
 
-		return fmt.Errorf("failed to publish message: %w", err)
+	return nil
+}
+
+// deadLetter moves a message that exhausted its retries to the dead letter table
+// and re-publishes it to the dead letter topic if one is configured
+func (p *Processor) deadLetter(ctx context.Context, msg *model.OutboxMessage, cause error) error {
+	deadLetter, err := p.repo.MoveToDeadLetter(ctx, msg.ID, p.instanceID, cause)
+	if err != nil {
+		logOutcomeError(err, "move message %s to dead letters", msg.ID)
+		return fmt.Errorf("failed to move message to dead letters: %w", err)
+	}
+	p.metrics.MessageDeadLettered(msg.Topic)
+
+	if p.config.DeadLetterTopic == "" {
+		return nil
+	}
+
+	// The dead letter is already stored, so a failure here is only logged
+	payload, err := json.Marshal(deadLetter)
+	if err != nil {
+		log.Printf("Failed to encode dead letter %s: %v", msg.ID, err)
+		return nil
 	}
 
-	// If publishing succeeded, mark the message as completed
-	if err := p.repo.MarkMessageAsCompleted(ctx, msg.ID); err != nil {
-		log.Printf("Failed to mark message %s as completed: %v", msg.ID, err)
-		return fmt.Errorf("failed to mark message as completed: %w", err)
+	headers := publishHeaders(deadLetter.Headers, deadLetter.ID, deadLetter.SequenceNumber)
+	if err := p.publisher.Publish(ctx, p.config.DeadLetterTopic, payload, headers); err != nil {
+		log.Printf("Failed to publish dead letter %s to %s: %v", msg.ID, p.config.DeadLetterTopic, err)
 	}
 
 	return nil
 }
+
+// fenced returns a context whose repository writes only take effect while epoch is the current
+// leadership epoch; epoch 0 leaves writes unfenced
+func fenced(ctx context.Context, epoch int64) context.Context {
+	if epoch == 0 {
+		return ctx
+	}
+	return repository.WithEpoch(ctx, epoch)
+}
+
+// publishHeaders returns the headers of a message together with the headers that identify
+// the outbox message it originates from
+func publishHeaders(headers map[string]string, id uuid.UUID, sequenceNumber int64) map[string]string {
+	result := make(map[string]string, len(headers)+2)
+	for key, value := range headers {
+		result[key] = value
+	}
+	result[publisher.HeaderMessageID] = id.String()
+	result[publisher.HeaderSequence] = strconv.FormatInt(sequenceNumber, 10)
+
+	return result
+}
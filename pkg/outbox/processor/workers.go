@@ -0,0 +1,162 @@
+package processor
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
+)
+
+// job is the share of a claimed batch handed to a single worker
+type job struct {
+	messages []*model.OutboxMessage
+	epoch    int64 // leadership epoch the messages were claimed in
+	batch    *claimedBatch
+}
+
+// claimedBatch tracks the jobs of a claimed batch, so that its duration is reported once all are done
+type claimedBatch struct {
+	start   time.Time
+	pending atomic.Int32
+}
+
+// workerPool publishes claimed messages on a fixed number of workers. Every message is routed to
+// the worker of its partition key, so messages that must stay in order are always published one
+// after another by the same worker. Messages without a key are spread across all workers.
+type workerPool struct {
+	lanes []chan job
+	slots chan struct{} // holds a token for every claimed message that is not yet published
+	wg    sync.WaitGroup
+}
+
+func newWorkerPool(workers, maxInFlight int) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Every job holds at least one slot, so lanes never block the dispatching loop
+	lanes := make([]chan job, workers)
+	for i := range lanes {
+		lanes[i] = make(chan job, maxInFlight)
+	}
+
+	return &workerPool{
+		lanes: lanes,
+		slots: make(chan struct{}, maxInFlight),
+	}
+}
+
+// maxInFlight returns the configured bound of in-flight messages, Workers * BatchSize by default
+func maxInFlight(workers, batchSize, configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return workers * batchSize
+}
+
+// acquire waits until n messages may be claimed, or as many as the in-flight bound allows if
+// that is lower, and reserves their slots. It returns the number of reserved slots, zero if the
+// processor is stopping.
+func (w *workerPool) acquire(ctx context.Context, stopCh <-chan struct{}, n int) int {
+	n = min(n, cap(w.slots))
+
+	for acquired := 0; acquired < n; acquired++ {
+		select {
+		case w.slots <- struct{}{}:
+		case <-stopCh:
+			w.release(acquired)
+			return 0
+		case <-ctx.Done():
+			w.release(acquired)
+			return 0
+		}
+	}
+
+	return n
+}
+
+// release frees n slots
+func (w *workerPool) release(n int) {
+	for i := 0; i < n; i++ {
+		<-w.slots
+	}
+}
+
+// lane returns the index of the worker that publishes the given message
+func (w *workerPool) lane(msg *model.OutboxMessage) int {
+	if len(w.lanes) == 1 {
+		return 0
+	}
+	if msg.PartitionKey == nil {
+		return int(uint64(msg.SequenceNumber) % uint64(len(w.lanes)))
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(*msg.PartitionKey))
+	return int(h.Sum32() % uint32(len(w.lanes)))
+}
+
+// dispatch splits a claimed batch between the workers, keeping the order of messages within each worker
+func (w *workerPool) dispatch(messages []*model.OutboxMessage, epoch int64, start time.Time) {
+	shares := make([][]*model.OutboxMessage, len(w.lanes))
+	for _, msg := range messages {
+		i := w.lane(msg)
+		shares[i] = append(shares[i], msg)
+	}
+
+	batch := &claimedBatch{start: start}
+	for _, share := range shares {
+		if len(share) > 0 {
+			batch.pending.Add(1)
+		}
+	}
+
+	for i, share := range shares {
+		if len(share) > 0 {
+			w.lanes[i] <- job{messages: share, epoch: epoch, batch: batch}
+		}
+	}
+}
+
+// startWorkers runs one worker per lane
+func (p *Processor) startWorkers(ctx context.Context) {
+	for _, lane := range p.workers.lanes {
+		p.workers.wg.Add(1)
+		go p.worker(ctx, lane)
+	}
+}
+
+// stopWorkers waits until the workers have published every message dispatched to them.
+// It must only be called once nothing is dispatched anymore.
+func (p *Processor) stopWorkers() {
+	for _, lane := range p.workers.lanes {
+		close(lane)
+	}
+	p.workers.wg.Wait()
+}
+
+// worker publishes the jobs of its lane one after another until the lane is closed
+func (p *Processor) worker(ctx context.Context, lane <-chan job) {
+	defer p.workers.wg.Done()
+
+	for j := range lane {
+		if err := p.publishBatch(fenced(ctx, j.epoch), j.messages); err != nil {
+			log.Printf("Error processing batch: %v", err)
+		}
+		p.workers.release(len(j.messages))
+
+		if j.batch.pending.Add(-1) == 0 {
+			p.metrics.BatchProcessed(time.Since(j.batch.start))
+		}
+	}
+}
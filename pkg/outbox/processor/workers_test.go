@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
+	"github.com/assylzhan-a/outboxie/pkg/outbox/publisher"
+)
+
+// claimRepository hands out its backlog to claims and records the requested limits
+type claimRepository struct {
+	*fakeRepository
+
+	backlog []*model.OutboxMessage
+	limits  []int
+}
+
+func (r *claimRepository) ClaimPendingMessages(_ context.Context, limit int, _ string, _ time.Duration) ([]*model.OutboxMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.limits = append(r.limits, limit)
+	n := min(limit, len(r.backlog))
+	claimed := r.backlog[:n]
+	r.backlog = r.backlog[n:]
+	return claimed, nil
+}
+
+// slowPublisher takes a while to publish every message and records the order per topic
+type slowPublisher struct {
+	fakePublisher
+
+	delay time.Duration
+	order map[string][]string
+}
+
+func (p *slowPublisher) Publish(_ context.Context, topic string, _ []byte, headers map[string]string) error {
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.order[topic] = append(p.order[topic], headers[publisher.HeaderMessageID])
+	return nil
+}
+
+func TestWorkerPoolLanes(t *testing.T) {
+	pool := newWorkerPool(4, 40)
+
+	key := "customer-1"
+	keyed := func(key string, sequence int64) *model.OutboxMessage {
+		return &model.OutboxMessage{PartitionKey: &key, SequenceNumber: sequence}
+	}
+	assert.Equal(t, pool.lane(keyed(key, 1)), pool.lane(keyed(key, 2)))
+
+	used := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		lane := pool.lane(keyed(uuid.NewString(), int64(i)))
+		require.GreaterOrEqual(t, lane, 0)
+		require.Less(t, lane, 4)
+		used[lane] = true
+	}
+	assert.Len(t, used, 4, "keys are spread across all workers")
+
+	used = map[int]bool{}
+	for i := int64(1); i <= 8; i++ {
+		used[pool.lane(&model.OutboxMessage{SequenceNumber: i})] = true
+	}
+	assert.Len(t, used, 4, "messages without a key are spread across all workers")
+
+	assert.Equal(t, 0, newWorkerPool(1, 10).lane(keyed(key, 3)))
+}
+
+func TestMaxInFlight(t *testing.T) {
+	assert.Equal(t, 40, maxInFlight(4, 10, 0))
+	assert.Equal(t, 25, maxInFlight(4, 10, 25))
+	assert.Equal(t, 10, maxInFlight(0, 10, 0))
+}
+
+func TestWorkersDrainOnStop(t *testing.T) {
+	cfg := config.DefaultProcessorConfig()
+	cfg.Workers = 3
+	cfg.BatchSize = 10
+	cfg.MaxInFlight = 4
+	cfg.PollingInterval = 10 * time.Millisecond
+
+	// Three keys with three messages each, plus three messages without a key
+	var backlog []*model.OutboxMessage
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			msg := newTestMessage(t, "orders."+key)
+			msg.PartitionKey = &key
+			backlog = append(backlog, msg)
+		}
+		unkeyed := newTestMessage(t, "orders.unkeyed")
+		unkeyed.SequenceNumber = int64(i + 1)
+		backlog = append(backlog, unkeyed)
+	}
+
+	repo := &claimRepository{fakeRepository: newFakeRepository(), backlog: backlog}
+	pub := &slowPublisher{delay: 5 * time.Millisecond, order: map[string][]string{}}
+	p := NewProcessor(repo, pub, NewStandaloneLeaderElection("test-instance"), "test-instance", cfg)
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+
+	require.Eventually(t, func() bool {
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		return len(repo.backlog) == 0
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// Every message that was claimed is published before Stop returns
+	require.NoError(t, p.Stop())
+	assert.Len(t, repo.completed, len(backlog))
+
+	// No claim ever exceeded the in-flight bound
+	for _, limit := range repo.limits {
+		assert.LessOrEqual(t, limit, cfg.MaxInFlight)
+	}
+
+	// Messages of a key are published in the order they were claimed, messages without a key in any order
+	expected := map[string][]string{}
+	for _, msg := range backlog {
+		expected[msg.Topic] = append(expected[msg.Topic], msg.ID.String())
+	}
+	assert.ElementsMatch(t, expected["orders.unkeyed"], pub.order["orders.unkeyed"])
+	delete(expected, "orders.unkeyed")
+	delete(pub.order, "orders.unkeyed")
+	assert.Equal(t, expected, pub.order)
+
+	// The workers are gone, so the processor cannot be restarted
+	assert.Error(t, p.Start(ctx))
+	assert.NoError(t, p.Stop())
+}
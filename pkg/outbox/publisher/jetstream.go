@@ -0,0 +1,164 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
+)
+
+// JetStreamPublisher publishes messages to a JetStream stream and waits for the stream to
+// acknowledge them, so a message is only reported as published once it has been persisted.
+// The outbox message ID is used as Nats-Msg-Id, letting the stream drop redeliveries.
+type JetStreamPublisher struct {
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	config config.JetStreamConfig
+	mu     sync.RWMutex // read-held while publishing, as the connection is safe for concurrent use
+}
+
+func NewJetStreamPublisher(natsURL string, cfg config.JetStreamConfig) (*JetStreamPublisher, error) {
+	conn, err := nats.Connect(natsURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	p := &JetStreamPublisher{
+		conn:   conn,
+		js:     js,
+		config: cfg,
+	}
+
+	if cfg.StreamName != "" {
+		if err := p.ensureStream(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// ensureStream verifies that the configured stream exists, creating it if allowed
+func (p *JetStreamPublisher) ensureStream() error {
+	_, err := p.js.StreamInfo(p.config.StreamName)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return fmt.Errorf("failed to look up stream %s: %w", p.config.StreamName, err)
+	}
+	if !p.config.CreateStream {
+		return fmt.Errorf("stream %s does not exist", p.config.StreamName)
+	}
+
+	_, err = p.js.AddStream(&nats.StreamConfig{
+		Name:       p.config.StreamName,
+		Subjects:   p.config.Subjects,
+		Duplicates: p.config.DuplicateWindow,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", p.config.StreamName, err)
+	}
+
+	return nil
+}
+
+func (p *JetStreamPublisher) Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.conn == nil || p.conn.IsClosed() {
+		return fmt.Errorf("NATS connection is closed")
+	}
+
+	msg := newJetStreamMsg(topic, payload, headers)
+
+	if p.config.AckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.AckTimeout)
+		defer cancel()
+	}
+
+	if _, err := p.js.PublishMsg(msg, nats.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	return nil
+}
+
+// PublishBatch publishes all messages asynchronously and then waits for the stream to
+// acknowledge each of them, so a batch takes about one round trip instead of one per message
+func (p *JetStreamPublisher) PublishBatch(ctx context.Context, messages []Message) []error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	errs := make([]error, len(messages))
+
+	if p.conn == nil || p.conn.IsClosed() {
+		return fillErrors(errs, fmt.Errorf("NATS connection is closed"))
+	}
+
+	futures := make([]nats.PubAckFuture, len(messages))
+	for i, message := range messages {
+		future, err := p.js.PublishMsgAsync(newJetStreamMsg(message.Topic, message.Payload, message.Headers))
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to publish message: %w", err)
+			continue
+		}
+		futures[i] = future
+	}
+
+	timeout := p.config.AckTimeout
+	if timeout <= 0 {
+		timeout = defaultFlushTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for i, future := range futures {
+		if future == nil {
+			continue
+		}
+
+		select {
+		case <-future.Ok():
+		case err := <-future.Err():
+			errs[i] = fmt.Errorf("failed to publish message: %w", err)
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("failed to publish message: no acknowledgement: %w", ctx.Err())
+		}
+	}
+
+	return errs
+}
+
+func (p *JetStreamPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil && !p.conn.IsClosed() {
+		p.conn.Close()
+	}
+
+	return nil
+}
+
+// newJetStreamMsg builds a message whose outbox message ID lets the stream detect duplicates
+func newJetStreamMsg(topic string, payload []byte, headers map[string]string) *nats.Msg {
+	msg := newMsg(topic, payload, headers)
+	if id := headers[HeaderMessageID]; id != "" {
+		msg.Header.Set(nats.MsgIdHdr, id)
+	}
+	return msg
+}
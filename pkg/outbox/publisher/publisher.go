@@ -4,19 +4,45 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	// HeaderMessageID carries the ID of the outbox message a published message originates from
+	HeaderMessageID = "Outbox-Message-Id"
+	// HeaderSequence carries the sequence number of the outbox message
+	HeaderSequence = "Outbox-Sequence"
+)
+
 type Publisher interface {
-	Publish(ctx context.Context, topic string, payload []byte) error
+	Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) error
 
 	Close() error
 }
 
+// Message is a single message of a batch
+type Message struct {
+	Topic   string
+	Payload []byte
+	Headers map[string]string
+}
+
+// BatchPublisher publishes a batch of messages without waiting for each message in turn.
+// The outcome of every message is returned at the same index, nil if it was published.
+type BatchPublisher interface {
+	Publisher
+
+	PublishBatch(ctx context.Context, messages []Message) []error
+}
+
+// defaultFlushTimeout bounds waiting for the broker when the context has no deadline
+const defaultFlushTimeout = 5 * time.Second
+
 type NatsPublisher struct {
 	conn *nats.Conn
-	mu   sync.Mutex
+	mu   sync.RWMutex // read-held while publishing, as the connection is safe for concurrent use
 }
 
 func NewNatsPublisher(natsURL string) (*NatsPublisher, error) {
@@ -30,15 +56,15 @@ func NewNatsPublisher(natsURL string) (*NatsPublisher, error) {
 	}, nil
 }
 
-func (p *NatsPublisher) Publish(ctx context.Context, topic string, payload []byte) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+func (p *NatsPublisher) Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
 	if p.conn == nil || p.conn.IsClosed() {
 		return fmt.Errorf("NATS connection is closed")
 	}
 
-	err := p.conn.Publish(topic, payload)
+	err := p.conn.PublishMsg(newMsg(topic, payload, headers))
 	if err != nil {
 		return fmt.Errorf("failed to publish message: %w", err)
 	}
@@ -46,6 +72,38 @@ func (p *NatsPublisher) Publish(ctx context.Context, topic string, payload []byt
 	return nil
 }
 
+// PublishBatch writes all messages to the connection buffer and then flushes it once,
+// so the batch costs a single round trip to the server. Core NATS does not acknowledge
+// messages, so if the flush fails every message of the batch is reported as failed.
+func (p *NatsPublisher) PublishBatch(ctx context.Context, messages []Message) []error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	errs := make([]error, len(messages))
+
+	if p.conn == nil || p.conn.IsClosed() {
+		return fillErrors(errs, fmt.Errorf("NATS connection is closed"))
+	}
+
+	for i, message := range messages {
+		if err := p.conn.PublishMsg(newMsg(message.Topic, message.Payload, message.Headers)); err != nil {
+			errs[i] = fmt.Errorf("failed to publish message: %w", err)
+		}
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultFlushTimeout)
+		defer cancel()
+	}
+
+	if err := p.conn.FlushWithContext(ctx); err != nil {
+		return fillErrors(errs, fmt.Errorf("failed to flush messages: %w", err))
+	}
+
+	return errs
+}
+
 func (p *NatsPublisher) Close() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -56,3 +114,22 @@ func (p *NatsPublisher) Close() error {
 
 	return nil
 }
+
+func newMsg(topic string, payload []byte, headers map[string]string) *nats.Msg {
+	msg := nats.NewMsg(topic)
+	msg.Data = payload
+	for key, value := range headers {
+		msg.Header.Set(key, value)
+	}
+	return msg
+}
+
+// fillErrors sets err for every message that has not failed already
+func fillErrors(errs []error, err error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
@@ -3,12 +3,16 @@ package publisher
 import (
 	"context"
 	"encoding/json"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
 )
 
 // TestNatsPublisher requires a running NATS instance.
@@ -26,10 +30,10 @@ func TestNatsPublisher(t *testing.T) {
 	require.NoError(t, err)
 	defer nc.Close()
 
-	msgCh := make(chan []byte, 1)
+	msgCh := make(chan *nats.Msg, 1)
 
 	sub, err := nc.Subscribe("test.topic", func(msg *nats.Msg) {
-		msgCh <- msg.Data
+		msgCh <- msg
 	})
 	require.NoError(t, err)
 	defer sub.Unsubscribe()
@@ -53,20 +57,236 @@ func TestNatsPublisher(t *testing.T) {
 
 	// Publish the message
 	ctx := context.Background()
-	err = pub.Publish(ctx, "test.topic", payload)
+	err = pub.Publish(ctx, "test.topic", payload, map[string]string{
+		HeaderMessageID:  "test-message-id",
+		"Correlation-Id": "test-correlation-id",
+	})
 	require.NoError(t, err)
 
 	// Wait for the message to be received
 	select {
-	case receivedData := <-msgCh:
+	case received := <-msgCh:
 		var receivedMsg TestMessage
-		err := json.Unmarshal(receivedData, &receivedMsg)
+		err := json.Unmarshal(received.Data, &receivedMsg)
 		require.NoError(t, err)
 
 		// Verify the message
 		assert.Equal(t, testMsg.Key, receivedMsg.Key)
 		assert.Equal(t, testMsg.Value, receivedMsg.Value)
+		assert.Equal(t, "test-message-id", received.Header.Get(HeaderMessageID))
+		assert.Equal(t, "test-correlation-id", received.Header.Get("Correlation-Id"))
 	case <-time.After(5 * time.Second):
 		t.Fatal("Timed out waiting for message")
 	}
 }
+
+// TestJetStreamPublisher requires a running NATS instance with JetStream enabled.
+func TestJetStreamPublisher(t *testing.T) {
+	natsURL := "nats://localhost:4222"
+	streamName := "OUTBOXIE_TEST"
+
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		t.Skip("NATS is not available:", err)
+		return
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	// Start from a fresh stream
+	_ = js.DeleteStream(streamName)
+	defer js.DeleteStream(streamName)
+
+	cfg := config.NewJetStreamConfig(streamName, "jstest.>")
+	cfg.CreateStream = true
+
+	pub, err := NewJetStreamPublisher(natsURL, cfg)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	headers := map[string]string{
+		HeaderMessageID: "test-message-id",
+		HeaderSequence:  "1",
+	}
+
+	// Publishing the same outbox message twice must only store it once
+	ctx := context.Background()
+	err = pub.Publish(ctx, "jstest.topic", []byte(`{"key":"value"}`), headers)
+	require.NoError(t, err)
+	err = pub.Publish(ctx, "jstest.topic", []byte(`{"key":"value"}`), headers)
+	require.NoError(t, err)
+
+	info, err := js.StreamInfo(streamName)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), info.State.Msgs)
+
+	stored, err := js.GetLastMsg(streamName, "jstest.topic")
+	require.NoError(t, err)
+	assert.Equal(t, "test-message-id", stored.Header.Get(nats.MsgIdHdr))
+	assert.Equal(t, "test-message-id", stored.Header.Get(HeaderMessageID))
+
+	// A subject outside of the stream is not acknowledged
+	err = pub.Publish(ctx, "not.captured", []byte(`{}`), nil)
+	assert.Error(t, err)
+}
+
+// TestNatsPublisherBatch requires a running NATS instance.
+func TestNatsPublisherBatch(t *testing.T) {
+	natsURL := "nats://localhost:4222"
+
+	pub, err := NewNatsPublisher(natsURL)
+	if err != nil {
+		t.Skip("NATS is not available:", err)
+		return
+	}
+	defer pub.Close()
+
+	nc, err := nats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+
+	msgCh := make(chan *nats.Msg, 10)
+
+	sub, err := nc.ChanSubscribe("batch.>", msgCh)
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	err = nc.Flush()
+	require.NoError(t, err)
+
+	messages := []Message{
+		{Topic: "batch.first", Payload: []byte(`{"n":1}`), Headers: map[string]string{HeaderMessageID: "1"}},
+		{Topic: "batch.second", Payload: []byte(`{"n":2}`), Headers: map[string]string{HeaderMessageID: "2"}},
+		{Topic: "batch.third", Payload: []byte(`{"n":3}`), Headers: map[string]string{HeaderMessageID: "3"}},
+	}
+
+	errs := pub.PublishBatch(context.Background(), messages)
+	require.Len(t, errs, len(messages))
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	// Messages arrive in the order of the batch
+	for _, expected := range messages {
+		select {
+		case received := <-msgCh:
+			assert.Equal(t, expected.Topic, received.Subject)
+			assert.Equal(t, expected.Payload, received.Data)
+			assert.Equal(t, expected.Headers[HeaderMessageID], received.Header.Get(HeaderMessageID))
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for message")
+		}
+	}
+
+	pub.Close()
+	errs = pub.PublishBatch(context.Background(), messages)
+	for _, err := range errs {
+		assert.Error(t, err)
+	}
+}
+
+// TestJetStreamPublisherBatch requires a running NATS instance with JetStream enabled.
+func TestJetStreamPublisherBatch(t *testing.T) {
+	natsURL := "nats://localhost:4222"
+	streamName := "OUTBOXIE_BATCH_TEST"
+
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		t.Skip("NATS is not available:", err)
+		return
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	_ = js.DeleteStream(streamName)
+	defer js.DeleteStream(streamName)
+
+	cfg := config.NewJetStreamConfig(streamName, "jsbatch.>")
+	cfg.CreateStream = true
+
+	pub, err := NewJetStreamPublisher(natsURL, cfg)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	messages := []Message{
+		{Topic: "jsbatch.topic", Payload: []byte(`{"n":1}`), Headers: map[string]string{HeaderMessageID: "1"}},
+		{Topic: "not.captured", Payload: []byte(`{"n":2}`), Headers: map[string]string{HeaderMessageID: "2"}},
+		{Topic: "jsbatch.topic", Payload: []byte(`{"n":3}`), Headers: map[string]string{HeaderMessageID: "3"}},
+		// A duplicate of the first message is acknowledged but not stored again
+		{Topic: "jsbatch.topic", Payload: []byte(`{"n":1}`), Headers: map[string]string{HeaderMessageID: "1"}},
+	}
+
+	errs := pub.PublishBatch(context.Background(), messages)
+	require.Len(t, errs, len(messages))
+	assert.NoError(t, errs[0])
+	assert.Error(t, errs[1], "a subject outside of the stream is not acknowledged")
+	assert.NoError(t, errs[2])
+	assert.NoError(t, errs[3])
+
+	info, err := js.StreamInfo(streamName)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), info.State.Msgs)
+}
+
+func runNatsServer(t *testing.T) string {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	require.NoError(t, err)
+
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+
+	return s.ClientURL()
+}
+
+func TestJetStreamPublisherBatchesOverlap(t *testing.T) {
+	natsURL := runNatsServer(t)
+
+	pub, err := NewJetStreamPublisher(natsURL, config.JetStreamConfig{AckTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	// A slow stream that acknowledges every message after a delay
+	const delay = 300 * time.Millisecond
+	nc, err := nats.Connect(natsURL)
+	require.NoError(t, err)
+	defer nc.Close()
+
+	sub, err := nc.Subscribe("slow.topic", func(msg *nats.Msg) {
+		go func() {
+			time.Sleep(delay)
+			msg.Respond([]byte(`{"stream":"SLOW","seq":1}`))
+		}()
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, nc.Flush())
+
+	// Two batches published at the same time wait for their acknowledgements together
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs := pub.PublishBatch(context.Background(), []Message{{Topic: "slow.topic", Payload: []byte("{}")}})
+			assert.NoError(t, errs[0])
+		}()
+	}
+	wg.Wait()
+
+	assert.Less(t, time.Since(start), 2*delay)
+}
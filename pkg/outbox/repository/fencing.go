@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrStaleEpoch is returned when a write is fenced by a leadership epoch that is no longer the
+// epoch of the leader row, because another instance has become the leader since
+var ErrStaleEpoch = errors.New("stale leadership epoch")
+
+type epochKey struct{}
+
+// WithEpoch fences the repository writes made with the returned context by the given leadership
+// epoch: they only take effect while it is still the epoch of the leader row, so a leader whose
+// term ended without noticing cannot change messages concurrently with its successor
+func WithEpoch(ctx context.Context, epoch int64) context.Context {
+	return context.WithValue(ctx, epochKey{}, epoch)
+}
+
+// EpochFromContext returns the leadership epoch that fences writes made with ctx, if any
+func EpochFromContext(ctx context.Context) (int64, bool) {
+	epoch, ok := ctx.Value(epochKey{}).(int64)
+	return epoch, ok
+}
+
+// fence returns a condition that holds while the epoch fencing ctx is the current leadership epoch,
+// with its arguments appended to args. Without an epoch the condition always holds.
+func (r *PostgresRepository) fence(ctx context.Context, args []any) (string, []any) {
+	epoch, ok := EpochFromContext(ctx)
+	if !ok {
+		return "TRUE", args
+	}
+
+	condition := fmt.Sprintf(
+		"EXISTS (SELECT 1 FROM %s WHERE id = $%d AND epoch = $%d)",
+		r.leaderElectionTable, len(args)+1, len(args)+2,
+	)
+	return condition, append(args, r.leaderKey, epoch)
+}
+
+// checkFence tells a write that changed nothing because its epoch is stale apart from one that
+// found no rows to change: it returns ErrStaleEpoch if ctx is fenced by an epoch that is not current
+func (r *PostgresRepository) checkFence(ctx context.Context) error {
+	epoch, ok := EpochFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	var current bool
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE id = $1 AND epoch = $2)", r.leaderElectionTable)
+	if err := r.db.QueryRow(ctx, query, r.leaderKey, epoch).Scan(&current); err != nil {
+		return fmt.Errorf("failed to check leadership epoch: %w", err)
+	}
+
+	if !current {
+		return fmt.Errorf("%w: %d", ErrStaleEpoch, epoch)
+	}
+
+	return nil
+}
+
+// lockLost returns ErrStaleEpoch if an outcome write left messages unchanged because ctx is fenced
+// by a stale epoch, and ErrLockLost for the given number of messages otherwise
+func (r *PostgresRepository) lockLost(ctx context.Context, lost int64, total int) error {
+	if err := r.checkFence(ctx); err != nil {
+		return err
+	}
+	if total == 1 {
+		return ErrLockLost
+	}
+	return fmt.Errorf("%w: %d of %d messages", ErrLockLost, lost, total)
+}
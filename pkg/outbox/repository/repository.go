@@ -4,12 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/assylzhan-a/outboxie/pkg/outbox/config"
 	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
 )
 
@@ -18,104 +21,322 @@ type Repository interface {
 
 	GetPendingMessages(ctx context.Context, limit int) ([]*model.OutboxMessage, error)
 
-	MarkMessageAsProcessing(ctx context.Context, id uuid.UUID) error
+	ClaimPendingMessages(ctx context.Context, limit int, lockedBy string, lockTimeout time.Duration) ([]*model.OutboxMessage, error)
 
-	MarkMessageAsCompleted(ctx context.Context, id uuid.UUID) error
+	MarkMessageAsProcessing(ctx context.Context, id uuid.UUID, lockedBy string, lockTimeout time.Duration) error
 
-	MarkMessageAsFailed(ctx context.Context, id uuid.UUID, err error) error
+	MarkMessageAsCompleted(ctx context.Context, id uuid.UUID, lockedBy string) error
+
+	MarkMessagesAsCompleted(ctx context.Context, ids []uuid.UUID, lockedBy string) error
+
+	MarkMessageAsFailed(ctx context.Context, id uuid.UUID, lockedBy string, err error) error
+
+	MarkMessageAsExpired(ctx context.Context, id uuid.UUID, lockedBy string, reason string) error
+
+	ScheduleRetry(ctx context.Context, id uuid.UUID, lockedBy string, err error, delay time.Duration) error
+
+	ScheduleRetries(ctx context.Context, retries []Retry, lockedBy string) error
+
+	MoveToDeadLetter(ctx context.Context, id uuid.UUID, lockedBy string, err error) (*model.DeadLetter, error)
+
+	ListDeadLetters(ctx context.Context, limit, offset int) ([]*model.DeadLetter, error)
+
+	RequeueDeadLetter(ctx context.Context, id uuid.UUID) error
+
+	DiscardDeadLetter(ctx context.Context, id uuid.UUID) error
+
+	ReleaseExpiredLocks(ctx context.Context) (int64, error)
+
+	GetBacklogStats(ctx context.Context) (*model.BacklogStats, error)
+
+	DeleteCompletedMessages(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	DeleteFailedMessages(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	DeleteDeadLetters(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	DeleteExpiredMessages(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	DeleteIdempotencyKeys(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	GetArchivedMessage(ctx context.Context, id uuid.UUID) (*model.OutboxMessage, error)
+
+	FindArchivedMessages(ctx context.Context, query model.ArchiveQuery) ([]*model.OutboxMessage, error)
+}
+
+// ErrDuplicateMessage is returned when a message is enqueued with the idempotency key of a
+// message enqueued before, whether or not that message is still in the outbox
+var ErrDuplicateMessage = errors.New("duplicate message")
+
+// ErrLockLost is returned when the outcome of a message is recorded by an instance that no longer
+// holds its lock: the lock expired, so the message was returned to pending and may have been
+// claimed by another instance. Nothing is changed for such messages.
+var ErrLockLost = errors.New("message lock lost")
+
+// Retry is a failed message to return to pending status, so that it is attempted again after Delay
+type Retry struct {
+	ID    uuid.UUID
+	Err   error
+	Delay time.Duration
+}
+
+// defaultArchiveLimit bounds archive queries that don't set a limit
+const defaultArchiveLimit = 100
+
+// appendErrorHistory returns the SQL expression that records a failed attempt, whose error
+// message is bound to the given query parameter, in the error_history of the row being updated
+func appendErrorHistory(param string) string {
+	return fmt.Sprintf(
+		`error_history || jsonb_build_array(jsonb_build_object('attempt', retry_count + 1, 'error', %s::text, 'failed_at', NOW()))`,
+		param,
+	)
 }
 
 type PostgresRepository struct {
-	db *pgxpool.Pool
+	db                   *pgxpool.Pool
+	notifyChannel        string
+	messagesTable        string
+	deadLettersTable     string
+	archiveTable         string
+	idempotencyKeysTable string
+	leaderElectionTable  string
+	leaderKey            string
+	archive              bool
+	priorityAging        time.Duration
+	fairShare            float64
+}
+
+// Option configures a PostgresRepository
+type Option func(*PostgresRepository)
+
+// WithNotifyChannel makes EnqueueMessage notify the given channel inside the enqueuing
+// transaction, so listeners are woken up as soon as the transaction commits
+func WithNotifyChannel(channel string) Option {
+	return func(r *PostgresRepository) {
+		r.notifyChannel = channel
+	}
+}
+
+// WithTables stores messages and dead letters in the tables named by the given configuration
+// instead of the default ones, and fences writes with the leader row it names
+func WithTables(tables config.TableConfig) Option {
+	return func(r *PostgresRepository) {
+		r.messagesTable = tables.Table(tables.Messages)
+		r.deadLettersTable = tables.Table(tables.DeadLetters)
+		r.archiveTable = tables.Table(tables.Archive)
+		r.idempotencyKeysTable = tables.Table(tables.IdempotencyKeys)
+		r.leaderElectionTable = tables.Table(tables.LeaderElection)
+		r.leaderKey = tables.LeaderKey
+	}
+}
+
+// WithArchive makes MarkMessageAsCompleted move completed messages to the archive table
+// instead of keeping them in the messages table
+func WithArchive() Option {
+	return func(r *PostgresRepository) {
+		r.archive = true
+	}
+}
+
+// WithPriorityAging raises the priority of a waiting message by one for every interval it waits,
+// so that a steady stream of high priority messages cannot starve lower priority ones. Aged
+// priorities cannot be read from an index, so every claim sorts all ready messages.
+func WithPriorityAging(interval time.Duration) Option {
+	return func(r *PostgresRepository) {
+		r.priorityAging = interval
+	}
+}
+
+// WithFairShare reserves the given share of every claim, rounded up, for the oldest ready messages
+// whatever their priority. A share below one always leaves room for at least one message by priority.
+func WithFairShare(share float64) Option {
+	return func(r *PostgresRepository) {
+		r.fairShare = share
+	}
 }
 
-func NewPostgresRepository(db *pgxpool.Pool) *PostgresRepository {
-	return &PostgresRepository{
-		db: db,
+func NewPostgresRepository(db *pgxpool.Pool, opts ...Option) *PostgresRepository {
+	defaults := config.DefaultTableConfig()
+	r := &PostgresRepository{
+		db:                   db,
+		messagesTable:        defaults.Table(defaults.Messages),
+		deadLettersTable:     defaults.Table(defaults.DeadLetters),
+		archiveTable:         defaults.Table(defaults.Archive),
+		idempotencyKeysTable: defaults.Table(defaults.IdempotencyKeys),
+		leaderElectionTable:  defaults.Table(defaults.LeaderElection),
+		leaderKey:            defaults.LeaderKey,
+		fairShare:            config.DefaultProcessorConfig().FairShare,
 	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
 }
 
-// EnqueueMessage stores a message in the outbox as part of a transaction
+// EnqueueMessage stores a message in the outbox as part of a transaction. Unless the message is
+// scheduled for a given time, it becomes available by the database clock, after its delivery
+// delay, and AvailableAt is set accordingly. If a message with the same idempotency key was enqueued
+// before, and its key was not deleted yet, nothing is stored and ErrDuplicateMessage is returned;
+// the transaction remains usable.
 func (r *PostgresRepository) EnqueueMessage(ctx context.Context, tx pgx.Tx, message *model.OutboxMessage) error {
-	query := `
-		INSERT INTO outbox_messages (
-			id, topic, payload, created_at, status
+	if message.IdempotencyKey != nil {
+		// The key is remembered in its own table, so it outlives the message being archived,
+		// dead-lettered or deleted, and is committed or rolled back together with the message
+		result, err := tx.Exec(ctx, fmt.Sprintf(`
+			INSERT INTO %s (idempotency_key, message_id)
+			VALUES ($1, $2)
+			ON CONFLICT (idempotency_key) DO NOTHING
+		`, r.idempotencyKeysTable), message.IdempotencyKey, message.ID)
+		if err != nil {
+			return fmt.Errorf("failed to store idempotency key: %w", err)
+		}
+		if result.RowsAffected() == 0 {
+			return ErrDuplicateMessage
+		}
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (
+			id, topic, payload, created_at, status, partition_key, headers, idempotency_key, available_at, expires_at,
+			priority
 		) VALUES (
-			$1, $2, $3, $4, $5
+			$1, $2, $3, $4, $5, $6, $7, $8, COALESCE($9, NOW() + $12::interval), $10, $11
 		)
-	`
+		RETURNING available_at
+	`, r.messagesTable)
 
-	_, err := tx.Exec(ctx, query,
+	err := tx.QueryRow(ctx, query,
 		message.ID,
 		message.Topic,
 		message.Payload,
 		message.CreatedAt,
 		message.Status,
-	)
+		message.PartitionKey,
+		headersOrEmpty(message.Headers),
+		message.IdempotencyKey,
+		availableAt(message),
+		message.ExpiresAt,
+		message.Priority,
+		message.DeliveryDelay,
+	).Scan(&message.AvailableAt)
 
 	if err != nil {
 		return fmt.Errorf("failed to enqueue message: %w", err)
 	}
 
+	if r.notifyChannel != "" {
+		// Notifications are delivered on commit and identical ones are folded into one per transaction
+		if _, err := tx.Exec(ctx, "SELECT pg_notify($1, '')", r.notifyChannel); err != nil {
+			return fmt.Errorf("failed to notify about enqueued message: %w", err)
+		}
+	}
+
 	return nil
 }
 
-// GetPendingMessages retrieves messages that need processing
+// GetPendingMessages retrieves messages that need processing, highest effective priority first
+// and in sequence order within the same priority
 func (r *PostgresRepository) GetPendingMessages(ctx context.Context, limit int) ([]*model.OutboxMessage, error) {
-	query := `
+	priority, args := r.effectivePriority([]any{model.StatusPending, model.StatusProcessing, limit})
+	query := fmt.Sprintf(`
 		SELECT 
-			id, topic, payload, created_at, processed_at, status, retry_count, error, sequence_number
+			%s
 		FROM 
-			outbox_messages
+			%s m
 		WHERE 
-			status = $1
+			%s
 		ORDER BY 
-			sequence_number ASC
-		LIMIT $2
-	`
+			%s DESC, sequence_number ASC
+		LIMIT $3
+	`, messageColumns, r.messagesTable, r.readyCondition(), priority)
 
-	rows, err := r.db.Query(ctx, query, model.StatusPending, limit)
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get pending messages: %w", err)
 	}
-	defer rows.Close()
 
-	var messages []*model.OutboxMessage
-	for rows.Next() {
-		var msg model.OutboxMessage
-		err := rows.Scan(
-			&msg.ID,
-			&msg.Topic,
-			&msg.Payload,
-			&msg.CreatedAt,
-			&msg.ProcessedAt,
-			&msg.Status,
-			&msg.RetryCount,
-			&msg.Error,
-			&msg.SequenceNumber,
+	return scanMessages(rows)
+}
+
+// ClaimPendingMessages atomically locks a batch of pending messages for the given instance and
+// marks them as processing. Rows locked by concurrent claims are skipped, so several instances
+// can claim batches at the same time without receiving the same message. The fair share of the
+// batch (see WithFairShare) goes to the oldest ready messages, the rest by priority. A claim fenced
+// by a stale leadership epoch (see WithEpoch) claims nothing and returns ErrStaleEpoch.
+func (r *PostgresRepository) ClaimPendingMessages(ctx context.Context, limit int, lockedBy string, lockTimeout time.Duration) ([]*model.OutboxMessage, error) {
+	priority, args := r.effectivePriority([]any{model.StatusPending, model.StatusProcessing, limit, lockedBy, lockTimeout})
+	fence, args := r.fence(ctx, args)
+	args = append(args, r.reserved(limit))
+
+	// Rows locked by the oldest share are not skipped by the same statement, so they are excluded
+	// explicitly. RETURNING does not preserve the order of the claim, so the claimed rows are sorted again.
+	query := fmt.Sprintf(`
+		WITH oldest AS (
+			SELECT id AS claim_id, %[1]s AS claim_priority
+			FROM %[2]s m
+			WHERE
+				%[3]s
+				AND %[4]s
+			ORDER BY sequence_number ASC
+			LIMIT $%[5]d
+			FOR UPDATE SKIP LOCKED
+		), prioritized AS (
+			SELECT id AS claim_id, %[1]s AS claim_priority
+			FROM %[2]s m
+			WHERE
+				%[3]s
+				AND %[4]s
+				AND m.id NOT IN (SELECT claim_id FROM oldest)
+			ORDER BY claim_priority DESC, sequence_number ASC
+			LIMIT $3 - (SELECT COUNT(*) FROM oldest)
+			FOR UPDATE SKIP LOCKED
+		), claimable AS (
+			SELECT * FROM oldest
+			UNION ALL
+			SELECT * FROM prioritized
+		), claimed AS (
+			UPDATE %[2]s
+			SET status = $2, locked_by = $4, locked_until = NOW() + $5::interval
+			FROM claimable
+			WHERE id = claim_id
+			RETURNING %[6]s, claim_priority
 		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan message: %w", err)
-		}
-		messages = append(messages, &msg)
+		SELECT %[6]s
+		FROM claimed
+		ORDER BY claim_priority DESC, sequence_number ASC
+	`, priority, r.messagesTable, r.readyCondition(), fence, len(args), messageColumns)
+
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim pending messages: %w", err)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating over messages: %w", err)
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		if err := r.checkFence(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	return messages, nil
 }
 
-// MarkMessageAsProcessing updates a message to processing status
-func (r *PostgresRepository) MarkMessageAsProcessing(ctx context.Context, id uuid.UUID) error {
-	query := `
-		UPDATE outbox_messages
-		SET status = $1
-		WHERE id = $2 AND status = $3
-	`
+// MarkMessageAsProcessing updates a message to processing status and locks it for the given
+// instance until the lock timeout elapses
+func (r *PostgresRepository) MarkMessageAsProcessing(ctx context.Context, id uuid.UUID, lockedBy string, lockTimeout time.Duration) error {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, locked_by = $2, locked_until = NOW() + $3::interval
+		WHERE id = $4 AND status = $5
+	`, r.messagesTable)
 
-	result, err := r.db.Exec(ctx, query, model.StatusProcessing, id, model.StatusPending)
+	result, err := r.db.Exec(ctx, query, model.StatusProcessing, lockedBy, lockTimeout, id, model.StatusPending)
 	if err != nil {
 		return fmt.Errorf("failed to mark message as processing: %w", err)
 	}
@@ -127,49 +348,643 @@ func (r *PostgresRepository) MarkMessageAsProcessing(ctx context.Context, id uui
 	return nil
 }
 
-// MarkMessageAsCompleted updates a message to completed status
-func (r *PostgresRepository) MarkMessageAsCompleted(ctx context.Context, id uuid.UUID) error {
-	now := time.Now().UTC()
-	query := `
-		UPDATE outbox_messages
-		SET status = $1, processed_at = $2
-		WHERE id = $3
-	`
+// MarkMessageAsCompleted updates a message processing under the lock of the given instance to
+// completed status, or in archive mode moves it to the archive table as completed
+func (r *PostgresRepository) MarkMessageAsCompleted(ctx context.Context, id uuid.UUID, lockedBy string) error {
+	return r.MarkMessagesAsCompleted(ctx, []uuid.UUID{id}, lockedBy)
+}
 
-	result, err := r.db.Exec(ctx, query, model.StatusCompleted, now, id)
+// MarkMessagesAsCompleted completes all the given messages in a single statement. Messages that are
+// no longer locked by the given instance are left unchanged and reported with ErrLockLost.
+func (r *PostgresRepository) MarkMessagesAsCompleted(ctx context.Context, ids []uuid.UUID, lockedBy string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var completed int64
+	var err error
+	if r.archive {
+		completed, err = r.archiveCompleted(ctx, ids, lockedBy)
+	} else {
+		completed, err = r.updateCompleted(ctx, ids, lockedBy)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to mark message as completed: %w", err)
+		return err
 	}
 
-	if result.RowsAffected() == 0 {
-		return errors.New("message not found")
+	if completed < int64(len(ids)) {
+		return r.lockLost(ctx, int64(len(ids))-completed, len(ids))
 	}
 
 	return nil
 }
 
-// MarkMessageAsFailed updates a message to failed status and increments retry count
-func (r *PostgresRepository) MarkMessageAsFailed(ctx context.Context, id uuid.UUID, err error) error {
-	query := `
-		UPDATE outbox_messages
-		SET status = $1, retry_count = retry_count + 1, error = $2
-		WHERE id = $3
-	`
+func (r *PostgresRepository) updateCompleted(ctx context.Context, ids []uuid.UUID, lockedBy string) (int64, error) {
+	fence, args := r.fence(ctx, []any{model.StatusCompleted, time.Now().UTC(), ids, model.StatusProcessing, lockedBy})
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, processed_at = $2, locked_by = NULL, locked_until = NULL
+		WHERE id = ANY($3) AND status = $4 AND locked_by = $5 AND %s
+	`, r.messagesTable, fence)
 
-	var errorMsg *string
+	result, err := r.db.Exec(ctx, query, args...)
 	if err != nil {
-		errStr := err.Error()
-		errorMsg = &errStr
+		return 0, fmt.Errorf("failed to mark messages as completed: %w", err)
 	}
 
-	result, err := r.db.Exec(ctx, query, model.StatusFailed, errorMsg, id)
+	return result.RowsAffected(), nil
+}
+
+// archiveCompleted deletes messages from the messages table and inserts them into the archive
+// as completed in a single statement, so a message is never in both tables or in neither
+func (r *PostgresRepository) archiveCompleted(ctx context.Context, ids []uuid.UUID, lockedBy string) (int64, error) {
+	fence, args := r.fence(ctx, []any{ids, time.Now().UTC(), model.StatusCompleted, model.StatusProcessing, lockedBy})
+	query := fmt.Sprintf(`
+		WITH moved AS (
+			DELETE FROM %s
+			WHERE id = ANY($1) AND status = $4 AND locked_by = $5 AND %s
+			RETURNING id, topic, payload, created_at, retry_count, error, sequence_number,
+				next_attempt_at, error_history, partition_key, headers, idempotency_key, available_at, expires_at, priority
+		)
+		INSERT INTO %s (
+			id, topic, payload, created_at, processed_at, status, retry_count, error, sequence_number,
+			next_attempt_at, error_history, partition_key, headers, idempotency_key, available_at, expires_at, priority
+		)
+		SELECT
+			id, topic, payload, created_at, $2, $3, retry_count, error, sequence_number,
+			next_attempt_at, error_history, partition_key, headers, idempotency_key, available_at, expires_at, priority
+		FROM moved
+	`, r.messagesTable, fence, r.archiveTable)
+
+	result, err := r.db.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive completed messages: %w", err)
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// MarkMessageAsFailed updates a message processing under the lock of the given instance to the
+// terminal failed status and increments retry count
+func (r *PostgresRepository) MarkMessageAsFailed(ctx context.Context, id uuid.UUID, lockedBy string, err error) error {
+	fence, args := r.fence(ctx, []any{model.StatusFailed, errorMessage(err), id, model.StatusProcessing, lockedBy})
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, retry_count = retry_count + 1, error = $2, error_history = %s,
+			locked_by = NULL, locked_until = NULL
+		WHERE id = $3 AND status = $4 AND locked_by = $5 AND %s
+	`, r.messagesTable, appendErrorHistory("$2"), fence)
+
+	result, err := r.db.Exec(ctx, query, args...)
 	if err != nil {
 		return fmt.Errorf("failed to mark message as failed: %w", err)
 	}
 
 	if result.RowsAffected() == 0 {
-		return errors.New("message not found")
+		return r.lockLost(ctx, 1, 1)
+	}
+
+	return nil
+}
+
+// MarkMessageAsExpired updates a message processing under the lock of the given instance that
+// expired before it could be published to the terminal expired status, recording the reason as its error
+func (r *PostgresRepository) MarkMessageAsExpired(ctx context.Context, id uuid.UUID, lockedBy string, reason string) error {
+	fence, args := r.fence(ctx, []any{model.StatusExpired, reason, id, model.StatusProcessing, lockedBy})
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, error = $2, locked_by = NULL, locked_until = NULL
+		WHERE id = $3 AND status = $4 AND locked_by = $5 AND %s
+	`, r.messagesTable, fence)
+
+	result, err := r.db.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to mark message as expired: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return r.lockLost(ctx, 1, 1)
 	}
 
 	return nil
 }
+
+// ScheduleRetry returns a message processing under the lock of the given instance to pending
+// status, increments retry count and defers the next attempt by the given delay
+func (r *PostgresRepository) ScheduleRetry(ctx context.Context, id uuid.UUID, lockedBy string, err error, delay time.Duration) error {
+	fence, args := r.fence(ctx, []any{model.StatusPending, errorMessage(err), delay, id, model.StatusProcessing, lockedBy})
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, retry_count = retry_count + 1, error = $2, error_history = %s,
+			next_attempt_at = NOW() + $3::interval, locked_by = NULL, locked_until = NULL
+		WHERE id = $4 AND status = $5 AND locked_by = $6 AND %s
+	`, r.messagesTable, appendErrorHistory("$2"), fence)
+
+	result, err := r.db.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to schedule message retry: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return r.lockLost(ctx, 1, 1)
+	}
+
+	return nil
+}
+
+// ScheduleRetries returns all the given messages to pending status in a single statement,
+// recording each one's error and deferring its next attempt by its own delay. Messages that are
+// no longer locked by the given instance are left unchanged and reported with ErrLockLost.
+func (r *PostgresRepository) ScheduleRetries(ctx context.Context, retries []Retry, lockedBy string) error {
+	if len(retries) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(retries))
+	errs := make([]*string, len(retries))
+	delays := make([]float64, len(retries))
+	for i, retry := range retries {
+		ids[i] = retry.ID
+		errs[i] = errorMessage(retry.Err)
+		delays[i] = retry.Delay.Seconds()
+	}
+
+	fence, args := r.fence(ctx, []any{model.StatusPending, ids, errs, delays, model.StatusProcessing, lockedBy})
+	query := fmt.Sprintf(`
+		UPDATE %s AS m
+		SET status = $1, retry_count = m.retry_count + 1, error = f.error, error_history = %s,
+			next_attempt_at = NOW() + make_interval(secs => f.delay), locked_by = NULL, locked_until = NULL
+		FROM unnest($2::uuid[], $3::text[], $4::float8[]) AS f(id, error, delay)
+		WHERE m.id = f.id AND m.status = $5 AND m.locked_by = $6 AND %s
+	`, r.messagesTable, appendErrorHistory("f.error"), fence)
+
+	result, err := r.db.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to schedule message retries: %w", err)
+	}
+
+	if lost := int64(len(retries)) - result.RowsAffected(); lost > 0 {
+		return r.lockLost(ctx, lost, len(retries))
+	}
+
+	return nil
+}
+
+// MoveToDeadLetter removes a message processing under the lock of the given instance that
+// exhausted its retries from the outbox and stores it, together with its error history, in the
+// dead letter table
+func (r *PostgresRepository) MoveToDeadLetter(ctx context.Context, id uuid.UUID, lockedBy string, err error) (*model.DeadLetter, error) {
+	fence, args := r.fence(ctx, []any{id, errorMessage(err), model.StatusProcessing, lockedBy})
+	query := fmt.Sprintf(`
+		WITH moved AS (
+			DELETE FROM %s
+			WHERE id = $1 AND status = $3 AND locked_by = $4 AND %s
+			RETURNING id, topic, payload, created_at, retry_count, error_history, sequence_number, partition_key, headers,
+				idempotency_key, available_at, expires_at, priority
+		)
+		INSERT INTO %s (
+			id, topic, payload, created_at, retry_count, error, error_history, sequence_number, partition_key, headers,
+			idempotency_key, available_at, expires_at, priority
+		)
+		SELECT
+			id, topic, payload, created_at, retry_count + 1, $2, %s, sequence_number, partition_key, headers,
+			idempotency_key, available_at, expires_at, priority
+		FROM moved
+		RETURNING %s
+	`, r.messagesTable, fence, r.deadLettersTable, appendErrorHistory("$2"), deadLetterColumns)
+
+	deadLetter, scanErr := scanDeadLetter(r.db.QueryRow(ctx, query, args...))
+	if errors.Is(scanErr, pgx.ErrNoRows) {
+		return nil, r.lockLost(ctx, 1, 1)
+	}
+	if scanErr != nil {
+		return nil, fmt.Errorf("failed to move message to dead letters: %w", scanErr)
+	}
+
+	return deadLetter, nil
+}
+
+// ListDeadLetters retrieves dead letters, most recently dead-lettered first
+func (r *PostgresRepository) ListDeadLetters(ctx context.Context, limit, offset int) ([]*model.DeadLetter, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			%s
+		ORDER BY
+			dead_lettered_at DESC, sequence_number DESC
+		LIMIT $1 OFFSET $2
+	`, deadLetterColumns, r.deadLettersTable)
+
+	rows, err := r.db.Query(ctx, query, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var deadLetters []*model.DeadLetter
+	for rows.Next() {
+		deadLetter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %w", err)
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over dead letters: %w", err)
+	}
+
+	return deadLetters, nil
+}
+
+// RequeueDeadLetter moves a dead letter back to the outbox as a pending message with a fresh retry
+// budget that is available immediately
+func (r *PostgresRepository) RequeueDeadLetter(ctx context.Context, id uuid.UUID) error {
+	query := fmt.Sprintf(`
+		WITH requeued AS (
+			DELETE FROM %s
+			WHERE id = $1
+			RETURNING id, topic, payload, created_at, error, error_history, partition_key, headers, idempotency_key,
+				expires_at, priority
+		)
+		INSERT INTO %s (
+			id, topic, payload, created_at, status, error, error_history, partition_key, headers, idempotency_key,
+			expires_at, priority
+		)
+		SELECT
+			id, topic, payload, created_at, $2, error, error_history, partition_key, headers, idempotency_key,
+			expires_at, priority
+		FROM requeued
+	`, r.deadLettersTable, r.messagesTable)
+
+	result, err := r.db.Exec(ctx, query, id, model.StatusPending)
+	if err != nil {
+		return fmt.Errorf("failed to requeue dead letter: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return errors.New("dead letter not found")
+	}
+
+	return nil
+}
+
+// DiscardDeadLetter permanently deletes a dead letter
+func (r *PostgresRepository) DiscardDeadLetter(ctx context.Context, id uuid.UUID) error {
+	result, err := r.db.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, r.deadLettersTable), id)
+	if err != nil {
+		return fmt.Errorf("failed to discard dead letter: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return errors.New("dead letter not found")
+	}
+
+	return nil
+}
+
+// ReleaseExpiredLocks returns messages whose processing lock expired, e.g. because the
+// instance that claimed them crashed, to pending status so they are picked up again
+func (r *PostgresRepository) ReleaseExpiredLocks(ctx context.Context) (int64, error) {
+	fence, args := r.fence(ctx, []any{model.StatusPending, model.StatusProcessing})
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET status = $1, locked_by = NULL, locked_until = NULL
+		WHERE status = $2 AND locked_until < NOW() AND %s
+	`, r.messagesTable, fence)
+
+	result, err := r.db.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release expired locks: %w", err)
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// reserved returns how many messages of a claim of the given size go to the oldest ready messages
+func (r *PostgresRepository) reserved(limit int) int {
+	if r.fairShare <= 0 {
+		return 0
+	}
+
+	n := int(math.Ceil(float64(limit) * r.fairShare))
+	if r.fairShare < 1 && n >= limit {
+		n = limit - 1
+	}
+	return max(n, 0)
+}
+
+// effectivePriority returns the SQL expression that ranks a ready message, together with args
+// extended by its parameters. Without aging it is the stored priority, so the priority index
+// returns messages in claim order. With aging the priority is raised by one for every aging
+// interval the message has been available, which depends on the current time, so every query
+// has to rank all ready messages.
+func (r *PostgresRepository) effectivePriority(args []any) (string, []any) {
+	if r.priorityAging <= 0 {
+		return "m.priority", args
+	}
+
+	expression := fmt.Sprintf(
+		`(m.priority + FLOOR(EXTRACT(EPOCH FROM NOW() - m.available_at) / $%d::float8))`,
+		len(args)+1,
+	)
+	return expression, append(args, r.priorityAging.Seconds())
+}
+
+// readyCondition matches pending messages ($1) that are available, due for their next attempt and
+// at the head of their partition: a keyed message is held back while an earlier message with the
+// same key is still pending or processing ($2), so a batch never contains two messages with the
+// same key. Earlier messages scheduled for later delivery don't hold back their partition.
+func (r *PostgresRepository) readyCondition() string {
+	return fmt.Sprintf(`m.status = $1
+			AND m.available_at <= NOW()
+			AND (m.next_attempt_at IS NULL OR m.next_attempt_at <= NOW())
+			AND (m.partition_key IS NULL OR NOT EXISTS (
+				SELECT 1
+				FROM %s prev
+				WHERE prev.partition_key = m.partition_key
+					AND prev.sequence_number < m.sequence_number
+					AND prev.status IN ($1, $2)
+					AND prev.available_at <= NOW()
+			))`, r.messagesTable)
+}
+
+// GetBacklogStats reports how many messages are waiting to be published and when the oldest was
+// enqueued. Messages scheduled for later delivery are not counted until they are available.
+func (r *PostgresRepository) GetBacklogStats(ctx context.Context) (*model.BacklogStats, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*), MIN(created_at)
+		FROM %s
+		WHERE status IN ($1, $2) AND available_at <= NOW()
+	`, r.messagesTable)
+
+	var stats model.BacklogStats
+	err := r.db.QueryRow(ctx, query, model.StatusPending, model.StatusProcessing).Scan(&stats.Pending, &stats.OldestCreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backlog stats: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// DeleteCompletedMessages deletes up to limit messages that were published before the given time
+func (r *PostgresRepository) DeleteCompletedMessages(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE id IN (
+			SELECT id
+			FROM %s
+			WHERE status = $1 AND processed_at < $2
+			LIMIT $3
+		)
+	`, r.messagesTable, r.messagesTable)
+
+	result, err := r.db.Exec(ctx, query, model.StatusCompleted, before, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete completed messages: %w", err)
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// DeleteFailedMessages deletes up to limit terminally failed messages enqueued before the given time
+func (r *PostgresRepository) DeleteFailedMessages(ctx context.Context, before time.Time, limit int) (int64, error) {
+	return r.deleteEnqueuedBefore(ctx, model.StatusFailed, before, limit)
+}
+
+// DeleteExpiredMessages deletes up to limit expired messages enqueued before the given time
+func (r *PostgresRepository) DeleteExpiredMessages(ctx context.Context, before time.Time, limit int) (int64, error) {
+	return r.deleteEnqueuedBefore(ctx, model.StatusExpired, before, limit)
+}
+
+// deleteEnqueuedBefore deletes up to limit messages with the given status enqueued before the given time
+func (r *PostgresRepository) deleteEnqueuedBefore(ctx context.Context, status model.OutboxMessageStatus, before time.Time, limit int) (int64, error) {
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE id IN (
+			SELECT id
+			FROM %s
+			WHERE status = $1 AND created_at < $2
+			LIMIT $3
+		)
+	`, r.messagesTable, r.messagesTable)
+
+	result, err := r.db.Exec(ctx, query, status, before, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete %s messages: %w", status, err)
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// DeleteDeadLetters deletes up to limit dead letters that were dead-lettered before the given time
+func (r *PostgresRepository) DeleteDeadLetters(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE id IN (
+			SELECT id
+			FROM %s
+			WHERE dead_lettered_at < $1
+			LIMIT $2
+		)
+	`, r.deadLettersTable, r.deadLettersTable)
+
+	result, err := r.db.Exec(ctx, query, before, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete dead letters: %w", err)
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// DeleteIdempotencyKeys deletes up to limit idempotency keys stored before the given time, so
+// that their messages can be enqueued again. Keys of messages still in the messages table are kept.
+func (r *PostgresRepository) DeleteIdempotencyKeys(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE idempotency_key IN (
+			SELECT k.idempotency_key
+			FROM %s k
+			WHERE k.created_at < $1
+				AND NOT EXISTS (SELECT 1 FROM %s m WHERE m.id = k.message_id)
+			LIMIT $2
+		)
+	`, r.idempotencyKeysTable, r.idempotencyKeysTable, r.messagesTable)
+
+	result, err := r.db.Exec(ctx, query, before, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete idempotency keys: %w", err)
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// GetArchivedMessage retrieves an archived message by ID
+func (r *PostgresRepository) GetArchivedMessage(ctx context.Context, id uuid.UUID) (*model.OutboxMessage, error) {
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE id = $1`, messageColumns, r.archiveTable)
+
+	rows, err := r.db.Query(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archived message: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("archived message not found")
+	}
+
+	return messages[0], nil
+}
+
+// FindArchivedMessages retrieves archived messages matching the query in the order they were enqueued
+func (r *PostgresRepository) FindArchivedMessages(ctx context.Context, query model.ArchiveQuery) ([]*model.OutboxMessage, error) {
+	var conditions []string
+	var args []any
+
+	if query.Topic != "" {
+		args = append(args, query.Topic)
+		conditions = append(conditions, fmt.Sprintf("topic = $%d", len(args)))
+	}
+	if !query.From.IsZero() {
+		args = append(args, query.From)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !query.To.IsZero() {
+		args = append(args, query.To)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultArchiveLimit
+	}
+	args = append(args, limit, query.Offset)
+
+	sql := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			%s
+		%s
+		ORDER BY
+			created_at ASC, sequence_number ASC
+		LIMIT $%d OFFSET $%d
+	`, messageColumns, r.archiveTable, where, len(args)-1, len(args))
+
+	rows, err := r.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find archived messages: %w", err)
+	}
+
+	return scanMessages(rows)
+}
+
+// messageColumns lists the messages table columns in the order scanMessages expects them
+const messageColumns = `id, topic, payload, created_at, processed_at, status, retry_count, error, sequence_number,
+			next_attempt_at, error_history, locked_by, locked_until, partition_key, headers, idempotency_key,
+			available_at, expires_at, priority`
+
+func scanMessages(rows pgx.Rows) ([]*model.OutboxMessage, error) {
+	defer rows.Close()
+
+	var messages []*model.OutboxMessage
+	for rows.Next() {
+		var msg model.OutboxMessage
+		err := rows.Scan(
+			&msg.ID,
+			&msg.Topic,
+			&msg.Payload,
+			&msg.CreatedAt,
+			&msg.ProcessedAt,
+			&msg.Status,
+			&msg.RetryCount,
+			&msg.Error,
+			&msg.SequenceNumber,
+			&msg.NextAttemptAt,
+			&msg.ErrorHistory,
+			&msg.LockedBy,
+			&msg.LockedUntil,
+			&msg.PartitionKey,
+			&msg.Headers,
+			&msg.IdempotencyKey,
+			&msg.AvailableAt,
+			&msg.ExpiresAt,
+			&msg.Priority,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, &msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// deadLetterColumns lists the dead letters table columns in the order scanDeadLetter expects them
+const deadLetterColumns = `id, topic, payload, created_at, dead_lettered_at, retry_count, error, error_history,
+			sequence_number, partition_key, headers, idempotency_key, available_at, expires_at, priority`
+
+func scanDeadLetter(row pgx.Row) (*model.DeadLetter, error) {
+	var deadLetter model.DeadLetter
+	err := row.Scan(
+		&deadLetter.ID,
+		&deadLetter.Topic,
+		&deadLetter.Payload,
+		&deadLetter.CreatedAt,
+		&deadLetter.DeadLetteredAt,
+		&deadLetter.RetryCount,
+		&deadLetter.Error,
+		&deadLetter.ErrorHistory,
+		&deadLetter.SequenceNumber,
+		&deadLetter.PartitionKey,
+		&deadLetter.Headers,
+		&deadLetter.IdempotencyKey,
+		&deadLetter.AvailableAt,
+		&deadLetter.ExpiresAt,
+		&deadLetter.Priority,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deadLetter, nil
+}
+
+// availableAt returns when a message scheduled for a given time may be published, or nil to let
+// the database decide
+func availableAt(message *model.OutboxMessage) *time.Time {
+	if message.AvailableAt.IsZero() {
+		return nil
+	}
+	return &message.AvailableAt
+}
+
+// headersOrEmpty avoids storing a JSON null for messages without headers
+func headersOrEmpty(headers map[string]string) map[string]string {
+	if headers == nil {
+		return map[string]string{}
+	}
+	return headers
+}
+
+func errorMessage(err error) *string {
+	if err == nil {
+		return nil
+	}
+
+	errStr := err.Error()
+	return &errStr
+}
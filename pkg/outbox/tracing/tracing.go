@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
+)
+
+// TracerName identifies the spans created by the outbox
+const TracerName = "github.com/assylzhan-a/outboxie/pkg/outbox"
+
+// propagator encodes span contexts as W3C traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+// Inject adds the span context of ctx to headers, unless headers already carry one,
+// and returns the resulting headers
+func Inject(ctx context.Context, headers map[string]string) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return headers
+	}
+
+	if headers == nil {
+		headers = make(map[string]string, len(carrier))
+	}
+	for _, key := range propagator.Fields() {
+		if _, exists := headers[key]; exists {
+			return headers
+		}
+	}
+	for key, value := range carrier {
+		headers[key] = value
+	}
+
+	return headers
+}
+
+// Extract returns a copy of ctx carrying the span context stored in headers
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// ExtractNats returns a copy of ctx carrying the span context stored in the headers of
+// a NATS message, allowing consumers to continue the trace of an outbox message
+func ExtractNats(ctx context.Context, header nats.Header) context.Context {
+	headers := make(map[string]string, len(propagator.Fields()))
+	for _, key := range propagator.Fields() {
+		if value := header.Get(key); value != "" {
+			headers[key] = value
+		}
+	}
+
+	return Extract(ctx, headers)
+}
+
+// StartPublishSpan starts the span covering the publishing of a message. The span belongs
+// to a new trace linked to the trace the message was enqueued in, since publishing happens
+// asynchronously and possibly long after the enqueuing request completed.
+func StartPublishSpan(ctx context.Context, tp trace.TracerProvider, msg *model.OutboxMessage) (context.Context, trace.Span) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.operation", "publish"),
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.String("messaging.message.id", msg.ID.String()),
+			attribute.Int64("outbox.sequence_number", msg.SequenceNumber),
+			attribute.Int("outbox.retry_count", msg.RetryCount),
+		),
+	}
+
+	origin := trace.SpanContextFromContext(Extract(context.Background(), msg.Headers))
+	if origin.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+	}
+
+	return tp.Tracer(TracerName).Start(ctx, "outbox publish", opts...)
+}
@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/assylzhan-a/outboxie/pkg/outbox/model"
+)
+
+func TestInjectAndExtract(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "enqueue")
+	defer span.End()
+
+	headers := Inject(ctx, nil)
+	require.Contains(t, headers, "traceparent")
+
+	extracted := trace.SpanContextFromContext(Extract(context.Background(), headers))
+	assert.Equal(t, span.SpanContext().TraceID(), extracted.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), extracted.SpanID())
+
+	// NATS consumers see the same span context
+	natsHeader := nats.Header{}
+	for key, value := range headers {
+		natsHeader.Set(key, value)
+	}
+	fromNats := trace.SpanContextFromContext(ExtractNats(context.Background(), natsHeader))
+	assert.Equal(t, span.SpanContext().TraceID(), fromNats.TraceID())
+}
+
+func TestInjectWithoutSpan(t *testing.T) {
+	assert.Nil(t, Inject(context.Background(), nil))
+
+	headers := map[string]string{"Correlation-Id": "123"}
+	assert.Equal(t, map[string]string{"Correlation-Id": "123"}, Inject(context.Background(), headers))
+}
+
+func TestInjectKeepsExplicitTraceParent(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "enqueue")
+	defer span.End()
+
+	explicit := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	headers := Inject(ctx, map[string]string{"traceparent": explicit})
+	assert.Equal(t, explicit, headers["traceparent"])
+}
+
+func TestStartPublishSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	enqueueCtx, enqueueSpan := tp.Tracer("test").Start(context.Background(), "enqueue")
+	enqueueSpan.End()
+
+	msg, err := model.NewOutboxMessage("orders.created", map[string]string{"key": "value"})
+	require.NoError(t, err)
+	msg.Headers = Inject(enqueueCtx, nil)
+
+	_, span := StartPublishSpan(context.Background(), tp, msg)
+	span.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+
+	publishSpan := spans[1]
+	assert.Equal(t, "outbox publish", publishSpan.Name())
+	assert.Equal(t, trace.SpanKindProducer, publishSpan.SpanKind())
+	require.Len(t, publishSpan.Links(), 1)
+	assert.Equal(t, enqueueSpan.SpanContext().TraceID(), publishSpan.Links()[0].SpanContext.TraceID())
+	assert.Equal(t, enqueueSpan.SpanContext().SpanID(), publishSpan.Links()[0].SpanContext.SpanID())
+}